@@ -3,21 +3,23 @@ package main
 import (
 	"net/http"
 	"fmt"
-	"log"
+	"log/slog"
 
 	"github.com/sideshow/apns2"
-	"github.com/sideshow/apns2/certificate"
 	"github.com/sideshow/apns2/payload"
 
 	"github.com/boltdb/bolt"
 
-	"errors"
 	"encoding/json"
 	"github.com/go-zoo/bone"
 	"github.com/renstrom/shortuuid"
 	"strconv"
 	"flag"
 	"strings"
+	"time"
+	"context"
+	"crypto/tls"
+	"os"
 )
 
 type BaseResponse struct {
@@ -30,7 +32,7 @@ func responseString(code int, message string)string {
 	t, _ := json.Marshal(BaseResponse{Code:code,Message:message})
 	return string(t)
 }
-func responseData(code int, data map[string]interface{} , message string)string {
+func responseData(code int, data interface{} , message string)string {
 	t, _ := json.Marshal(BaseResponse{Code:code,Data:data, Message:message})
 	return string(t)
 }
@@ -47,15 +49,25 @@ func Index(w http.ResponseWriter, r *http.Request) {
 	body := bone.GetValue(r, "body")
 
 	defer r.Body.Close()
+	logger := requestLogger(r).With(secret("key", redactKey, key))
 
-	deviceToken ,err := getDeviceTokenByKey(key)
-	if err != nil {
-		log.Println("找不到key对应的DeviceToken key: " + key)
+	if !keyExists(key) {
+		logger.Info("找不到key对应的DeviceToken")
 		fmt.Fprint(w, responseString(400,"找不到key对应的DeviceToken, 请确保Key正确! Key可在App端注册获得。"))
 		return
 	}
 
 	r.ParseForm()
+	dryRun := isDryRun(r)
+	r.Form.Del("dry_run")
+
+	if !dryRun {
+		if e := checkLimit(key, clientIP(r)); e != nil {
+			logger.Warn("推送被限制", "reason", e.Message, "retry_after", e.RetryAfter)
+			writeLimited(w, e)
+			return
+		}
+	}
 
 	if len(title) <= 0 && len(body) <= 0 {
 		//url中不包含 title body，则从Form里取
@@ -75,22 +87,34 @@ func Index(w http.ResponseWriter, r *http.Request) {
 	}
 
 	params := make(map[string]interface{})
+	paramNames := make([]string, 0, len(r.Form))
 	for key,value := range r.Form {
+		// title 和 body 已经在 alert 中，不再重复放进 payload
+		if strings.ToLower(key) == "title" || strings.ToLower(key) == "body" {
+			continue
+		}
 		params[strings.ToLower(key)] = value[0]
+		paramNames = append(paramNames, strings.ToLower(key))
 	}
 
-	log.Println(" ========================== ")
-	log.Println("key: ", key)
-	log.Println("category: ", category)
-	log.Println("title: ", title)
-	log.Println("body: ", body)
-	log.Println("params: ", params)
-	log.Println(" ========================== ")
+	logger.Debug("收到推送",
+		"category", category,
+		secret("title", redactBody, title),
+		secret("body", redactBody, body),
+		"params", paramNames,
+	)
 
-	err = postPush(category,title,body,deviceToken,params)
+	msg := &Message{Category: category, Title: title, Body: body, Params: params}
+	if dryRun {
+		writePreview(w, key, msg)
+		return
+	}
+	err := pushToKey(r.Context(), key, msg)
 	if err != nil {
+		logger.Warn("推送失败", "err", err)
 		fmt.Fprint(w, responseString(400, err.Error()))
 	} else{
+		logger.Info("推送成功")
 		fmt.Fprint(w, responseString(200, ""))
 	}
 }
@@ -107,53 +131,47 @@ func register(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	providerName := r.FormValue("provider")
+	if len(providerName) <= 0 {
+		providerName = "apns"
+	}
+	if providerName == "webpush" && len(deviceToken) <= 0 {
+		deviceToken = readPushSubscription(r)
+	}
+
 	if len(deviceToken) <= 0 {
 		fmt.Fprint(w, responseString(400, "deviceToken 不能为空"))
 		return
 	}
+	provider := providers[providerName]
+	if provider == nil {
+		fmt.Fprint(w, responseString(400, "服务器未启用推送方式 " + providerName))
+		return
+	}
+	if err := provider.ValidateTarget(deviceToken); err != nil {
+		fmt.Fprint(w, responseString(400, err.Error()))
+		return
+	}
 
+	//如果已经注册，则更新DeviceToken的值
 	oldKey := r.FormValue("key")
-	boltDB.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte("device"))
-		if err != nil {
-			return  err
-		}
-
-		if len(oldKey) >0 {
-			//如果已经注册，则更新DeviceToken的值
-			val := bucket.Get([]byte(oldKey))
-			if val != nil {
-				key = oldKey
-			}
-		}
-
-		bucket.Put([]byte(key), []byte(deviceToken))
-		return nil
-	})
-	log.Println("注册设备成功")
-	log.Println("key: ", key)
-	log.Println("deviceToken: ", deviceToken)
+	if len(oldKey) > 0 && keyExists(oldKey) {
+		key = oldKey
+	}
+	if err := saveDevice(key, Device{Provider: providerName, Token: deviceToken}); err != nil {
+		requestLogger(r).Error("保存设备失败", "err", err)
+		fmt.Fprint(w, responseString(500, "注册失败"))
+		return
+	}
+	requestLogger(r).Info("注册设备成功",
+		secret("key", redactKey, key),
+		"provider", providerName,
+		secret("device_token", redactToken, deviceToken),
+	)
 	fmt.Fprint(w, responseData(200, map[string]interface{}{"key":key}, "注册成功"))
 }
 
 
-func getDeviceTokenByKey(key string) (string,error){
-	var deviceTokenBytes []byte
-	err := boltDB.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("device"))
-		deviceTokenBytes = bucket.Get([]byte(key))
-		if deviceTokenBytes == nil {
-			return errors.New("没找到DeviceToken")
-		}
-		return nil
-	})
-	if err != nil {
-		return "", err
-	}
-
-	return string(deviceTokenBytes), nil
-}
-
 func getb() []byte {
 	//测试证书
 	if IsDev{
@@ -163,53 +181,115 @@ func getb() []byte {
 	return []byte{}
 }
 
-func postPush(category string, title string, body string, deviceToken string,  params map[string]interface{}) error{
+// APNs 限制 payload 最大 4KB
+const apnsMaxPayload = 4096
+
+// 推送参数 level 对应的 aps.interruption-level
+var interruptionLevels = map[string]payload.EInterruptionLevel{
+	"passive":       payload.InterruptionLevelPassive,
+	"active":        payload.InterruptionLevelActive,
+	"timeSensitive": payload.InterruptionLevelTimeSensitive,
+	"critical":      payload.InterruptionLevelCritical,
+}
+
+// 按消息生成 APNs 请求，payload 超过大小限制时截断正文，第二个返回值表示是否截断过
+func buildNotification(deviceToken string, msg *Message) (*apns2.Notification, bool) {
+	build := func(body string) *apns2.Notification {
+		notification := &apns2.Notification{}
+		notification.DeviceToken = deviceToken
+
+		payload := payload.NewPayload().Sound("1107").Category("myNotificationCategory")
+		badge := msg.Params["badge"]
+		if badge != nil {
+			badgeStr, pass := badge.(string)
+			if pass {
+				badgeNum, err := strconv.Atoi(badgeStr)
+				if err == nil {
+					payload = payload.Badge(badgeNum)
+				}
+			}
+		}
 
-	notification := &apns2.Notification{}
-	notification.DeviceToken = deviceToken
+		if group, ok := msg.Params["group"].(string); ok && len(group) > 0 {
+			payload = payload.ThreadID(group)
+		}
 
-	payload := payload.NewPayload().Sound("1107").Category("myNotificationCategory")
-	badge := params["badge"]
-	if badge != nil {
-		badgeStr, pass := badge.(string)
-		if pass {
-			badgeNum, err := strconv.Atoi(badgeStr)
-			if err == nil {
-				payload = payload.Badge(badgeNum)
+		// level 决定通知的打扰程度，要放在 aps 中，不作为自定义字段发送
+		name, _ := msg.Params["level"].(string)
+		if level, ok := interruptionLevels[name]; ok {
+			payload = payload.InterruptionLevel(level)
+		}
+		for key, value := range msg.Params {
+			if key == "level" {
+				continue
 			}
+			payload = payload.Custom(key, value)
+		}
+		if len(msg.Title) > 0 {
+			payload.AlertTitle(msg.Title)
+		}
+		if len(body) > 0 {
+			payload.AlertBody(body)
 		}
+		notification.Payload = payload
+		notification.Topic = "me.fin.bark"
+		// 相同 collapse_id 的通知在设备上只保留最新的一条，APNs 限制为 64 字节
+		if collapseID, ok := msg.Params["collapse_id"].(string); ok && len(collapseID) <= 64 {
+			notification.CollapseID = collapseID
+		}
+		return notification
 	}
 
-	for key, value := range params {
-		payload = payload.Custom(key, value)
+	notification := build(msg.Body)
+	data, err := json.Marshal(notification.Payload)
+	if err != nil || len(data) <= apnsMaxPayload {
+		return notification, false
 	}
-	if len(title) > 0 {
-		payload.AlertTitle(title)
+	// 转义后的长度和原文不同，按超出的字节数从末尾删字，直到放得下
+	runes := []rune(msg.Body)
+	n := len(runes)
+	for len(data) > apnsMaxPayload && n > 0 {
+		drop := 0
+		for drop < len(data)-apnsMaxPayload+len("…") && n > 0 {
+			n--
+			escaped, _ := json.Marshal(string(runes[n]))
+			drop += len(escaped) - 2
+		}
+		notification = build(string(runes[:n]) + "…")
+		data, _ = json.Marshal(notification.Payload)
 	}
-	if len(body) > 0 {
-		payload.AlertBody(body)
+	return notification, true
+}
+
+func postPush(ctx context.Context, deviceToken string, msg *Message) error{
+
+	notification, truncated := buildNotification(deviceToken, msg)
+	if truncated {
+		slog.Debug("推送内容超过APNs限制，已截断正文")
 	}
-	notification.Payload = payload
-	notification.Topic = "me.fin.bark"
-	res, err := apnsClient.Push(notification)
+	cred := acquireAPNs()
+	res, err := cred.client.PushWithContext(ctx, notification)
+	cred.release()
 
 	if err != nil {
-		log.Println("Error:", err)
-		return errors.New("与苹果推送服务器传输数据失败")
+		slog.Error("与苹果推送服务器传输数据失败", "err", err)
+		return &PushError{Message: "与苹果推送服务器传输数据失败", Reason: "TransportError"}
 	}
-	log.Printf("%v %v %v\n", res.StatusCode, res.ApnsID, res.Reason)
+	slog.Debug("APNs响应", "status", res.StatusCode, "apns_id", res.ApnsID, "reason", res.Reason)
 	if res.StatusCode == 200 {
 		return nil
 	}else{
-		return errors.New("推送发送失败 " + res.Reason)
+		return apnsError(res)
 	}
 
 
 }
 
 var IsDev bool = false
+var TrustProxy bool = false
+var DailyQuota int = 0
+var keyLimiter, ipLimiter, globalLimiter *rateLimiter
 var boltDB *bolt.DB
-var apnsClient *apns2.Client
 func main()  {
 	//f,_:= os.Open("./BarkPush.p12")
 	//t,_ := ioutil.ReadAll(f)
@@ -224,53 +304,274 @@ func main()  {
 	ip := flag.String("ip",  "0.0.0.0", "http listen ip")
 	port := flag.Int("port",  8080, "http listen port")
 	dev := flag.Bool("dev", false, "develop推送，请忽略此参数，设置此参数为True会导致推送失败")
+	keyRate := flag.Float64("key-rate", 1, "每个key每秒允许的推送数，0为不限制")
+	keyBurst := flag.Int("key-burst", 10, "每个key允许的突发推送数")
+	ipRate := flag.Float64("ip-rate", 2, "每个来源IP每秒允许的推送数，0为不限制")
+	ipBurst := flag.Int("ip-burst", 20, "每个来源IP允许的突发推送数")
+	globalRate := flag.Float64("global-rate", 0, "整个服务每秒允许的推送数，0为不限制")
+	globalBurst := flag.Int("global-burst", 100, "整个服务允许的突发推送数")
+	dailyQuota := flag.Int("daily-quota", 0, "每个key每天默认允许的推送数，0为不限制，可通过 /meta/:key 单独设置")
+	trustProxy := flag.Bool("trust-proxy", false, "从 X-Forwarded-For / X-Real-IP 获取来源IP，仅在反向代理后使用，X-Forwarded-For 中反向代理的内网地址会被跳过")
+	logFormat := flag.String("log-format", "text", "日志格式: text(logfmt) 或 json")
+	logLevel := flag.String("log-level", "info", "日志级别: debug, info, warn, error")
+	logRedact := flag.String("log-redact", "key,token,body", "日志中需要脱敏的内容，逗号分隔: key, token, body")
+	logRedactMode := flag.String("log-redact-mode", "hash", "脱敏方式: hash, truncate 或 none")
+	access := flag.Bool("access-log", false, "为每个请求输出一条访问日志")
+	readTimeout := flag.Duration("read-timeout", 10*time.Second, "读取请求的超时时间")
+	writeTimeout := flag.Duration("write-timeout", 30*time.Second, "写入响应的超时时间")
+	idleTimeout := flag.Duration("idle-timeout", 120*time.Second, "keep-alive 连接的空闲超时时间")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "退出时等待请求和队列处理完毕的最长时间")
+	shutdownDelay := flag.Duration("shutdown-delay", 5*time.Second, "收到退出信号后继续处理请求的时间，期间 /readyz 返回 503，方便负载均衡摘除流量")
+	tlsCert := flag.String("tls-cert", "", "HTTPS 证书文件，与 -tls-key 一起设置后启用 TLS，收到 SIGHUP 时重新加载")
+	tlsKey := flag.String("tls-key", "", "HTTPS 私钥文件")
+	tlsClientCA := flag.String("tls-client-ca", "", "客户端证书的CA文件，设置后启用双向TLS认证")
+	tlsClientAuth := flag.String("tls-client-auth", "require", "双向TLS认证方式: require 必须提供客户端证书, optional 提供时才校验")
+	unixSocket := flag.String("unix-socket", "", "监听 Unix socket 文件，代替 -ip -port")
+	unixSocketMode := flag.Uint("unix-socket-mode", 0660, "Unix socket 文件权限")
+	systemd := flag.Bool("systemd", false, "使用 systemd socket activation 传入的监听")
+	certWarnDays := flag.Int("cert-warn-days", 30, "推送证书剩余有效期不超过该天数时输出警告")
+	adminKeys := flag.String("admin-keys", "", "推送证书即将过期时接收提醒的key，逗号分隔")
+	apnsCertFile := flag.String("apns-cert", "", "推送证书文件(.p12 或 .pem)，文件变化、SIGHUP 或调用管理接口时重新加载，不设置则使用内置证书")
+	apnsCertPassword := flag.String("apns-cert-password", "", "推送证书密码")
+	adminToken := flag.String("admin-token", "", "管理接口的token，不设置则关闭管理接口")
+	fcmCredentials := flag.String("fcm-credentials", "", "Firebase 服务账号JSON文件，设置后启用 FCM 推送")
+	fcmEndpoint := flag.String("fcm-endpoint", "", "FCM 接口地址，默认 https://fcm.googleapis.com")
+	webhook := flag.Bool("webhook-provider", false, "允许注册 webhook 类型的设备，推送时服务器会请求设备提供的URL")
+	webhookURLs := flag.String("webhooks", "", "每次推送后都会通知的全局webhook地址，逗号分隔")
+	webhookSecret := flag.String("webhook-secret", "", "全局webhook的签名密钥")
+	webhookAllowPrivate := flag.Bool("webhook-allow-private", false, "允许 webhook 订阅和 webhook 设备使用回环、内网地址，仅在推送到内网服务时使用")
+	webhookAttempts := flag.Int("webhook-attempts", 5, "webhook投递失败时的最多尝试次数，超过后记为死信")
+	historyLimit := flag.Int("history-limit", 100, "每个key保存的历史消息条数，用于 /:key/stream 断线后补发")
+	idempotencyTTL := flag.Duration("idempotency-ttl", 24*time.Hour, "相同 Idempotency-Key 的推送请求在这段时间内只处理一次")
+	smtpAddr := flag.String("smtp-addr", "", "内嵌 SMTP 服务的监听地址，例如 :2525，设置后把发给 <key>@<domain> 的邮件转成推送")
+	smtpDomain := flag.String("smtp-domain", "", "SMTP 只接收发往这个域名的邮件，不设置则不检查")
+	smtpAllow := flag.String("smtp-allow", "", "允许的发件人，完整地址或 @域名，逗号分隔，不设置则不限制")
+	smtpMaxSize := flag.Int("smtp-max-size", 1<<20, "邮件的最大字节数，附件也计算在内")
+	mqttBroker := flag.String("mqtt-broker", "", "MQTT 服务器地址，例如 tcp://127.0.0.1:1883，设置后订阅 -mqtt-topic 并把消息转成推送")
+	mqttClientID := flag.String("mqtt-client-id", "bark-server", "MQTT 客户端ID")
+	mqttUsername := flag.String("mqtt-username", "", "MQTT 用户名")
+	mqttPassword := flag.String("mqtt-password", "", "MQTT 密码")
+	mqttTopic := flag.String("mqtt-topic", "bark/+/push", "订阅的 topic，+ 代表 key")
+	mqttResultTopic := flag.String("mqtt-result-topic", "bark/{key}/result", "推送结果发布到的 topic，{key} 替换为 key，为空则不发布")
+	mqttQoS := flag.Int("mqtt-qos", 1, "订阅和发布结果使用的 QoS")
+	vapidSubject := flag.String("vapid-subject", "", "VAPID 联系方式(mailto: 或 https: 地址)，设置后启用浏览器推送")
 	flag.Parse()
 
+	if err := setupLogger(*logFormat, *logLevel, *logRedact, *logRedactMode); err != nil {
+		fatal("日志配置错误", "err", err)
+	}
+	AccessLog = *access
+	AdminToken = *adminToken
+
 	IsDev = *dev
+	TrustProxy = *trustProxy
+	DailyQuota = *dailyQuota
+	WebhookAllowPrivate = *webhookAllowPrivate
+	keyLimiter = newRateLimiter(*keyRate, *keyBurst)
+	ipLimiter = newRateLimiter(*ipRate, *ipBurst)
+	globalLimiter = newRateLimiter(*globalRate, *globalBurst)
 
 	db, err := bolt.Open("bark.db", 0600, nil)
 	if err != nil {
-		log.Fatalln(err)
+		fatal("打开数据库失败", "err", err)
 	}
-	defer  db.Close()
 	boltDB = db
 
 	boltDB.Update(func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists([]byte("device"))
 		if err != nil {
-			log.Fatalln(err)
+			fatal("创建bucket失败", "err", err)
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("meta"))
+		if err != nil {
+			fatal("创建bucket失败", "err", err)
 		}
 		return err
 	})
 
-	cert, err := certificate.FromP12Bytes(getb(),"bp")
+	cred, err := loadAPNsCredential(*apnsCertFile, *apnsCertPassword)
 	if err != nil {
-		log.Fatalln("cer error")
+		fatal("加载推送证书失败", "err", err)
+	}
+	swapAPNs(cred)
+	onReload("apns", func() error {
+		return reloadAPNs(*apnsCertFile, *apnsCertPassword)
+	})
+	if len(*apnsCertFile) > 0 {
+		if err := watchAPNsCertificate(*apnsCertFile, *apnsCertPassword); err != nil {
+			slog.Warn("无法监听推送证书文件，只能通过 SIGHUP 或管理接口重新加载", "err", err)
+		}
+	}
+	registerProvider(apnsProvider{})
+	if len(*fcmCredentials) > 0 {
+		fcm, err := newFCMProvider(*fcmCredentials, *fcmEndpoint)
+		if err != nil {
+			fatal("加载FCM服务账号失败", "err", err)
+		}
+		registerProvider(fcm)
+	}
+	if *webhook {
+		registerProvider(newWebhookProvider())
+	}
+	var webPush *webPushProvider
+	if len(*vapidSubject) > 0 {
+		webPush, err = newWebPushProvider(*vapidSubject)
+		if err != nil {
+			fatal("加载VAPID密钥失败", "err", err)
+		}
+		registerProvider(webPush)
 	}
-	apnsClient = apns2.NewClient(cert).Production()
 
+	registerAdapter(githubAdapter{})
+	registerAdapter(gitlabAdapter{})
+	registerAdapter(grafanaAdapter{})
+	registerAdapter(slackAdapter{})
 
+	dispatcher := newWebhookDispatcher(splitKeys(*webhookURLs), *webhookSecret, *webhookAttempts, 4)
+	onPush(dispatcher.onPush)
 
-	addr := *ip + ":" + strconv.Itoa(*port)
-	log.Println("Serving HTTP on " + addr)
+	HistoryLimit = *historyLimit
+	onPush(recordHistory)
 
-	r := bone.New()
-	r.Get("/ping", http.HandlerFunc(ping))
-	r.Post("/ping", http.HandlerFunc(ping))
+	go monitorCertificate(*certWarnDays, splitKeys(*adminKeys))
+	go runQuietHours()
+	startDigest()
+	IdempotencyTTL = *idempotencyTTL
+	go runIdempotencyCleanup()
 
-	r.Get("/register", http.HandlerFunc(register))
-	r.Post("/register", http.HandlerFunc(register))
+	if len(*smtpAddr) > 0 {
+		err := startSMTP(smtpConfig{Addr: *smtpAddr, Domain: *smtpDomain, Allow: splitKeys(*smtpAllow), MaxSize: *smtpMaxSize})
+		if err != nil {
+			fatal("SMTP 监听失败", "err", err)
+		}
+	}
+	if len(*mqttBroker) > 0 {
+		// 先检查范围再转成 byte，避免 -mqtt-qos 256 这样的值溢出成 0
+		if *mqttQoS < 0 || *mqttQoS > 2 {
+			fatal("MQTT 配置错误", "err", "mqtt qos 只能是 0、1 或 2")
+		}
+		err := startMQTT(mqttConfig{
+			Broker:      *mqttBroker,
+			ClientID:    *mqttClientID,
+			Username:    *mqttUsername,
+			Password:    *mqttPassword,
+			Topic:       *mqttTopic,
+			ResultTopic: *mqttResultTopic,
+			QoS:         byte(*mqttQoS),
+		})
+		if err != nil {
+			fatal("MQTT 配置错误", "err", err)
+		}
+	}
+	// 退出时按注册顺序执行。合并窗口中的推送在退出时才发出，它们触发的 webhook 仍要投递，
+	// 所以 dispatcher 在其它会产生推送的部分之后注册，最后关闭
+	onShutdown(dispatcher.shutdown)
 
-	r.Get("/:key/:body", http.HandlerFunc(Index))
-	r.Post("/:key/:body", http.HandlerFunc(Index))
 
-	r.Get("/:key/:title/:body", http.HandlerFunc(Index))
-	r.Post("/:key/:title/:body", http.HandlerFunc(Index))
 
-	r.Get("/:key/:category/:title/:body", http.HandlerFunc(Index))
-	r.Post("/:key/:category/:title/:body", http.HandlerFunc(Index))
+	addr := *ip + ":" + strconv.Itoa(*port)
+	listeners, err := listen(addr, *unixSocket, os.FileMode(*unixSocketMode), *systemd)
+	if err != nil {
+		fatal("监听失败", "err", err)
+	}
 
+	var tlsConfig *tls.Config
+	if len(*tlsCert) > 0 || len(*tlsKey) > 0 {
+		clientAuth, err := parseClientAuth(*tlsClientAuth)
+		if err != nil {
+			fatal("TLS配置错误", "err", err)
+		}
+		reloader, err := newCertReloader(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			fatal("加载HTTPS证书失败", "err", err)
+		}
+		onReload("tls", reloader.reload)
+		tlsConfig = reloader.tlsConfig(clientAuth)
+	}
+
+	r := bone.New()
+	r.Get("/ping", instrument("/ping", ping))
+	r.Post("/ping", instrument("/ping", ping))
 
-	log.Fatal(http.ListenAndServe(addr, r))
+	r.Get("/register", instrument("/register", register))
+	r.Post("/register", instrument("/register", register))
+
+	r.Get("/metrics", metricsHandler())
+	r.Get("/healthz", instrument("/healthz", healthz))
+	r.Get("/readyz", instrument("/readyz", readyz))
+	r.Post("/admin/apns/reload", instrument("/admin/apns/reload", apnsReloadHandler(*apnsCertFile, *apnsCertPassword)))
+
+	if webPush != nil {
+		r.Get("/webpush/vapid", instrument("/webpush/vapid", vapidPublicKey(webPush)))
+	}
+
+	r.Get("/webhook/:key", instrument("/webhook/:key", webhooks))
+	r.Post("/webhook/:key", instrument("/webhook/:key", webhooks))
+	r.Get("/webhook/:key/log", instrument("/webhook/:key/log", webhookLog))
+	r.Delete("/webhook/:key/:id", instrument("/webhook/:key/:id", deleteWebhook))
+
+	r.Post("/push", instrument("/push", idempotent(pushJSON)))
+	r.Post("/message", instrument("/message", idempotent(gotifyPush)))
+	r.Get("/gotify/:key", instrument("/gotify/:key", gotifyApps))
+	r.Post("/gotify/:key", instrument("/gotify/:key", gotifyApps))
+	r.Delete("/gotify/:key/:token", instrument("/gotify/:key/:token", deleteGotifyApp))
+	r.Get("/ntfy/:key", instrument("/ntfy/:key", ntfyTopics))
+	r.Put("/ntfy/:key/:topic", instrument("/ntfy/:key/:topic", ntfyTopic))
+	r.Post("/ntfy/:key/:topic", instrument("/ntfy/:key/:topic", ntfyTopic))
+	r.Delete("/ntfy/:key/:topic", instrument("/ntfy/:key/:topic", ntfyTopic))
+	r.Post("/alertmanager/:target", instrument("/alertmanager/:target", idempotent(alertmanagerReceiver)))
+	r.Post("/incoming/:source/:target", instrument("/incoming/:source/:target", idempotent(incoming)))
+	r.Post("/incoming/:source/:target/secret", instrument("/incoming/:source/:target/secret", incomingSecret))
+	r.Delete("/incoming/:source/:target/secret", instrument("/incoming/:source/:target/secret", incomingSecret))
+	r.Get("/template/:key", instrument("/template/:key", templates))
+	r.Get("/template/:key/:name", instrument("/template/:key/:name", templateHandler))
+	r.Post("/template/:key/:name", instrument("/template/:key/:name", templateHandler))
+	r.Put("/template/:key/:name", instrument("/template/:key/:name", templateHandler))
+	r.Delete("/template/:key/:name", instrument("/template/:key/:name", templateHandler))
+	r.Post("/template/:key/:name/preview", instrument("/template/:key/:name/preview", templatePreview))
+	r.Get("/template/:key/:name/push", instrument("/template/:key/:name/push", idempotent(templatePush)))
+	r.Post("/template/:key/:name/push", instrument("/template/:key/:name/push", idempotent(templatePush)))
+	r.Get("/quiet/:key", instrument("/quiet/:key", quietHours))
+	r.Post("/quiet/:key", instrument("/quiet/:key", quietHours))
+	r.Put("/quiet/:key", instrument("/quiet/:key", quietHours))
+	r.Delete("/quiet/:key", instrument("/quiet/:key", quietHours))
+	r.Get("/digest/:key", instrument("/digest/:key", digestSettings))
+	r.Post("/digest/:key", instrument("/digest/:key", digestSettings))
+	r.Put("/digest/:key", instrument("/digest/:key", digestSettings))
+	r.Delete("/digest/:key", instrument("/digest/:key", digestSettings))
+	r.Get("/rules/:key", instrument("/rules/:key", rulesHandler))
+	r.Post("/rules/:key", instrument("/rules/:key", rulesHandler))
+	r.Put("/rules/:key", instrument("/rules/:key", rulesHandler))
+	r.Delete("/rules/:key", instrument("/rules/:key", rulesHandler))
+	r.Post("/rules/:key/test", instrument("/rules/:key/test", testRules))
+	r.Get("/meta/:key", instrument("/meta/:key", keyMeta))
+	r.Post("/meta/:key", instrument("/meta/:key", keyMeta))
+
+	r.Get("/:key/stream", instrument("/:key/stream", stream))
+	r.Get("/:key/:body", instrument("/:key/:body", idempotent(Index)))
+	r.Post("/:key/:body", instrument("/:key/:body", idempotent(Index)))
+
+	r.Get("/:key/:title/:body", instrument("/:key/:title/:body", idempotent(Index)))
+	r.Post("/:key/:title/:body", instrument("/:key/:title/:body", idempotent(Index)))
+
+	r.Get("/:key/:category/:title/:body", instrument("/:key/:category/:title/:body", idempotent(Index)))
+	r.Post("/:key/:category/:title/:body", instrument("/:key/:category/:title/:body", idempotent(Index)))
+
+	r.Post("/", instrument("/", idempotent(ntfyPublishJSON)))
+	r.Post("/:topic", instrument("/:topic", idempotent(ntfyPublish)))
+	r.Put("/:topic", instrument("/:topic", idempotent(ntfyPublish)))
+
+
+	srv := &http.Server{
+		Handler:           r,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: *readTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+	// SSE 和 WebSocket 长连接不会自己结束，开始关闭时主动断开
+	srv.RegisterOnShutdown(closeStreams)
+	serve(srv, listeners, *shutdownDelay, *shutdownTimeout)
 }
 
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sideshow/apns2"
+	"github.com/sideshow/apns2/certificate"
+)
+
+// 一份 APNs 证书和用它创建的 client，替换后旧的 client 会等进行中的推送结束再释放连接
+type apnsCredential struct {
+	client   *apns2.Client
+	cert     *x509.Certificate
+	inflight sync.WaitGroup
+}
+
+var apnsMu sync.RWMutex
+var apnsCurrent *apnsCredential
+
+// 取当前的 client 用于一次推送，用完必须调用 release
+func acquireAPNs() *apnsCredential {
+	apnsMu.RLock()
+	defer apnsMu.RUnlock()
+	apnsCurrent.inflight.Add(1)
+	return apnsCurrent
+}
+
+func (c *apnsCredential) release() {
+	c.inflight.Done()
+}
+
+func currentCert() *x509.Certificate {
+	apnsMu.RLock()
+	defer apnsMu.RUnlock()
+	if apnsCurrent == nil {
+		return nil
+	}
+	return apnsCurrent.cert
+}
+
+// 从文件加载证书，.pem 按 PEM 解析，其余按 P12 解析；file 为空时使用内置证书。
+// 过期的证书也会加载，由健康检查、指标和 monitorCertificate 报告，不影响其它推送方式
+func loadAPNsCredential(file string, password string) (*apnsCredential, error) {
+	var cert tls.Certificate
+	var err error
+	switch {
+	case len(file) == 0:
+		cert, err = certificate.FromP12Bytes(getb(), "bp")
+	case strings.EqualFold(filepath.Ext(file), ".pem"):
+		cert, err = certificate.FromPemFile(file, password)
+	default:
+		cert, err = certificate.FromP12File(file, password)
+	}
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := parseLeaf(cert.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	return &apnsCredential{
+		client: apns2.NewClient(cert).Production(),
+		cert:   leaf,
+	}, nil
+}
+
+func swapAPNs(cred *apnsCredential) {
+	apnsMu.Lock()
+	old := apnsCurrent
+	apnsCurrent = cred
+	apnsMu.Unlock()
+
+	if time.Now().After(cred.cert.NotAfter) {
+		slog.Warn("推送证书已过期，APNs 推送将会失败", "subject", cred.cert.Subject.CommonName, "expires_at", cred.cert.NotAfter)
+	} else {
+		slog.Info("推送证书已加载", "subject", cred.cert.Subject.CommonName, "expires_at", cred.cert.NotAfter, "days_left", certDaysLeft(cred.cert))
+	}
+	if old == nil {
+		return
+	}
+	go func() {
+		old.inflight.Wait()
+		if old.client.HTTPClient != nil {
+			old.client.HTTPClient.CloseIdleConnections()
+		}
+		slog.Debug("旧的推送证书已释放", "subject", old.cert.Subject.CommonName)
+	}()
+}
+
+// 重新加载证书文件，校验失败或新证书已过期时继续使用当前证书
+func reloadAPNs(file string, password string) error {
+	cred, err := loadAPNsCredential(file, password)
+	if err != nil {
+		return err
+	}
+	if time.Now().After(cred.cert.NotAfter) {
+		return errors.New("推送证书已于 " + cred.cert.NotAfter.Format("2006-01-02 15:04:05") + " 过期")
+	}
+	swapAPNs(cred)
+	return nil
+}
+
+// 监听证书文件所在目录，兼容先写临时文件再 rename 的更新方式
+func watchAPNsCertificate(file string, password string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		var timer *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != filepath.Clean(file) || event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				// 一次更新可能触发多个事件，等文件写完再加载
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(time.Second, func() {
+					if err := reloadAPNs(file, password); err != nil {
+						slog.Error("推送证书文件变化，重新加载失败", "file", file, "err", err)
+					}
+				})
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Warn("监听推送证书文件出错", "err", err)
+			}
+		}
+	}()
+	return nil
+}
+
+type apnsProvider struct{}
+
+func (apnsProvider) Name() string {
+	return "apns"
+}
+
+func (apnsProvider) ValidateTarget(token string) error {
+	if len(token) < 64 || len(token)%2 != 0 {
+		return errors.New("deviceToken 格式不正确")
+	}
+	if _, err := hex.DecodeString(token); err != nil {
+		return errors.New("deviceToken 格式不正确")
+	}
+	return nil
+}
+
+func (apnsProvider) Send(ctx context.Context, token string, msg *Message) error {
+	return postPush(ctx, token, msg)
+}
+
+// 按 APNs 返回的 reason 区分错误，DeviceToken 失效的需要移除
+func apnsError(res *apns2.Response) *PushError {
+	e := &PushError{Message: "推送发送失败 " + res.Reason, Reason: res.Reason}
+	switch res.Reason {
+	case apns2.ReasonBadDeviceToken, apns2.ReasonUnregistered, apns2.ReasonDeviceTokenNotForTopic:
+		e.Permanent = true
+		e.Invalid = true
+	case apns2.ReasonTooManyRequests, apns2.ReasonInternalServerError, apns2.ReasonServiceUnavailable, apns2.ReasonShutdown:
+	default:
+		e.Permanent = res.StatusCode >= 400 && res.StatusCode < 500
+	}
+	return e
+}
+
+var AdminToken string
+
+func checkAdminToken(r *http.Request) bool {
+	if len(AdminToken) == 0 {
+		return false
+	}
+	token := r.Header.Get("Authorization")
+	if strings.HasPrefix(token, "Bearer ") {
+		token = strings.TrimPrefix(token, "Bearer ")
+	} else {
+		token = r.FormValue("token")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(AdminToken)) == 1
+}
+
+func apnsReloadHandler(file string, password string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if !checkAdminToken(r) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, responseString(403, "需要管理员token，未设置 -admin-token 时此接口不可用"))
+			return
+		}
+		if err := reloadAPNs(file, password); err != nil {
+			requestLogger(r).Error("重新加载推送证书失败", "err", err)
+			fmt.Fprint(w, responseString(400, "重新加载推送证书失败 "+err.Error()))
+			return
+		}
+		cert := currentCert()
+		fmt.Fprint(w, responseData(200, map[string]interface{}{
+			"subject":    cert.Subject.CommonName,
+			"expires_at": cert.NotAfter,
+		}, "重新加载成功"))
+	}
+}
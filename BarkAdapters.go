@@ -0,0 +1,429 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 正文最多列出的提交数
+const adapterMaxCommits = 5
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n]) + "…"
+}
+
+func shortRef(ref string) string {
+	ref = strings.TrimPrefix(ref, "refs/heads/")
+	return strings.TrimPrefix(ref, "refs/tags/")
+}
+
+func adapterMessage(title string, body string, link string, group string) *Message {
+	params := map[string]interface{}{}
+	if len(link) > 0 {
+		params["url"] = link
+	}
+	if len(group) > 0 {
+		params["group"] = group
+	}
+	return &Message{Title: title, Body: truncate(body, 1000), Params: params}
+}
+
+func verifyHMAC(signature string, body []byte, secret string) error {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(expected)) != 1 {
+		return errors.New("签名不正确")
+	}
+	return nil
+}
+
+type githubAdapter struct{}
+
+func (githubAdapter) Name() string {
+	return "github"
+}
+
+// X-Hub-Signature-256: sha256=HMAC-SHA256(secret, body)
+func (githubAdapter) Verify(r *http.Request, body []byte, secret string) error {
+	signature := r.Header.Get("X-Hub-Signature-256")
+	if !strings.HasPrefix(signature, "sha256=") {
+		return errors.New("缺少 X-Hub-Signature-256 签名")
+	}
+	return verifyHMAC(strings.TrimPrefix(signature, "sha256="), body, secret)
+}
+
+type githubEvent struct {
+	Action  string `json:"action"`
+	Ref     string `json:"ref"`
+	Compare string `json:"compare"`
+	Deleted bool   `json:"deleted"`
+	Commits []struct {
+		Message string `json:"message"`
+	} `json:"commits"`
+	Repository struct {
+		FullName string `json:"full_name"`
+		HTMLURL  string `json:"html_url"`
+	} `json:"repository"`
+	Sender struct {
+		Login string `json:"login"`
+	} `json:"sender"`
+	PullRequest struct {
+		Number  int    `json:"number"`
+		Title   string `json:"title"`
+		HTMLURL string `json:"html_url"`
+		Merged  bool   `json:"merged"`
+	} `json:"pull_request"`
+	Issue struct {
+		Number  int    `json:"number"`
+		Title   string `json:"title"`
+		HTMLURL string `json:"html_url"`
+	} `json:"issue"`
+	Comment struct {
+		Body    string `json:"body"`
+		HTMLURL string `json:"html_url"`
+	} `json:"comment"`
+	Release struct {
+		TagName string `json:"tag_name"`
+		Name    string `json:"name"`
+		HTMLURL string `json:"html_url"`
+	} `json:"release"`
+	WorkflowRun struct {
+		Name       string `json:"name"`
+		HeadBranch string `json:"head_branch"`
+		Conclusion string `json:"conclusion"`
+		HTMLURL    string `json:"html_url"`
+	} `json:"workflow_run"`
+}
+
+func (githubAdapter) Translate(r *http.Request, body []byte) (*Message, error) {
+	kind := r.Header.Get("X-GitHub-Event")
+	if len(kind) == 0 {
+		return nil, errors.New("缺少 X-GitHub-Event 请求头")
+	}
+	if kind == "ping" {
+		return nil, nil
+	}
+	e := &githubEvent{}
+	if err := json.Unmarshal(body, e); err != nil {
+		return nil, errors.New("GitHub webhook 格式不正确")
+	}
+	repo := e.Repository.FullName
+	title := "[" + repo + "] "
+	user := e.Sender.Login
+
+	switch kind {
+	case "push":
+		branch := shortRef(e.Ref)
+		if e.Deleted {
+			return adapterMessage(title+"删除 "+branch, user+" 删除了 "+branch, e.Repository.HTMLURL, repo), nil
+		}
+		if len(e.Commits) == 0 {
+			return nil, nil
+		}
+		lines := []string{user + " 推送了 " + strconv.Itoa(len(e.Commits)) + " 个提交"}
+		for i, commit := range e.Commits {
+			if i == adapterMaxCommits {
+				lines = append(lines, "…")
+				break
+			}
+			lines = append(lines, "- "+firstLine(commit.Message))
+		}
+		return adapterMessage(title+"push 到 "+branch, strings.Join(lines, "\n"), e.Compare, repo), nil
+	case "pull_request":
+		action := e.Action
+		if action == "closed" && e.PullRequest.Merged {
+			action = "merged"
+		}
+		return adapterMessage(title+"PR #"+strconv.Itoa(e.PullRequest.Number)+" "+action,
+			user+": "+e.PullRequest.Title, e.PullRequest.HTMLURL, repo), nil
+	case "issues":
+		return adapterMessage(title+"Issue #"+strconv.Itoa(e.Issue.Number)+" "+e.Action,
+			user+": "+e.Issue.Title, e.Issue.HTMLURL, repo), nil
+	case "issue_comment":
+		if e.Action != "created" {
+			return nil, nil
+		}
+		return adapterMessage(title+"#"+strconv.Itoa(e.Issue.Number)+" 新评论",
+			user+": "+e.Comment.Body, e.Comment.HTMLURL, repo), nil
+	case "release":
+		if e.Action != "published" {
+			return nil, nil
+		}
+		name := e.Release.Name
+		if len(name) == 0 {
+			name = e.Release.TagName
+		}
+		return adapterMessage(title+"发布 "+e.Release.TagName, user+" 发布了 "+name, e.Release.HTMLURL, repo), nil
+	case "workflow_run":
+		if e.Action != "completed" {
+			return nil, nil
+		}
+		return adapterMessage(title+e.WorkflowRun.Name+" "+e.WorkflowRun.Conclusion,
+			e.WorkflowRun.HeadBranch+" 上的 "+e.WorkflowRun.Name+" 运行结果: "+e.WorkflowRun.Conclusion, e.WorkflowRun.HTMLURL, repo), nil
+	case "star":
+		if e.Action != "created" {
+			return nil, nil
+		}
+		return adapterMessage(title+"新的 Star", user+" star 了 "+repo, e.Repository.HTMLURL, repo), nil
+	}
+	text := user + " 触发了 " + kind
+	if len(e.Action) > 0 {
+		text += " (" + e.Action + ")"
+	}
+	return adapterMessage(title+kind, text, e.Repository.HTMLURL, repo), nil
+}
+
+type gitlabAdapter struct{}
+
+func (gitlabAdapter) Name() string {
+	return "gitlab"
+}
+
+// GitLab 不做签名，而是在 X-Gitlab-Token 中原样带上配置的 Secret token
+func (gitlabAdapter) Verify(r *http.Request, body []byte, secret string) error {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), []byte(secret)) != 1 {
+		return errors.New("X-Gitlab-Token 不正确")
+	}
+	return nil
+}
+
+type gitlabEvent struct {
+	ObjectKind        string `json:"object_kind"`
+	Ref               string `json:"ref"`
+	After             string `json:"after"`
+	UserName          string `json:"user_name"`
+	TotalCommitsCount int    `json:"total_commits_count"`
+	Commits           []struct {
+		Message string `json:"message"`
+		URL     string `json:"url"`
+	} `json:"commits"`
+	User struct {
+		Name string `json:"name"`
+	} `json:"user"`
+	Project struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+		WebURL            string `json:"web_url"`
+	} `json:"project"`
+	ObjectAttributes struct {
+		ID           int    `json:"id"`
+		IID          int    `json:"iid"`
+		Title        string `json:"title"`
+		Action       string `json:"action"`
+		State        string `json:"state"`
+		Status       string `json:"status"`
+		Ref          string `json:"ref"`
+		URL          string `json:"url"`
+		Note         string `json:"note"`
+		NoteableType string `json:"noteable_type"`
+	} `json:"object_attributes"`
+	// release 事件的字段在顶层
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	Tag    string `json:"tag"`
+	URL    string `json:"url"`
+}
+
+func (gitlabAdapter) Translate(r *http.Request, body []byte) (*Message, error) {
+	e := &gitlabEvent{}
+	if err := json.Unmarshal(body, e); err != nil || len(e.ObjectKind) == 0 {
+		return nil, errors.New("GitLab webhook 格式不正确")
+	}
+	project := e.Project.PathWithNamespace
+	title := "[" + project + "] "
+	user := e.UserName
+	if len(user) == 0 {
+		user = e.User.Name
+	}
+	attrs := e.ObjectAttributes
+
+	switch e.ObjectKind {
+	case "push", "tag_push":
+		ref := shortRef(e.Ref)
+		// 删除分支或标签时 after 全为 0
+		if strings.Trim(e.After, "0") == "" {
+			return adapterMessage(title+"删除 "+ref, user+" 删除了 "+ref, e.Project.WebURL, project), nil
+		}
+		if e.ObjectKind == "tag_push" {
+			return adapterMessage(title+"新标签 "+ref, user+" 推送了标签 "+ref, e.Project.WebURL+"/-/tags/"+ref, project), nil
+		}
+		lines := []string{user + " 推送了 " + strconv.Itoa(e.TotalCommitsCount) + " 个提交"}
+		for i, commit := range e.Commits {
+			if i == adapterMaxCommits {
+				lines = append(lines, "…")
+				break
+			}
+			lines = append(lines, "- "+firstLine(commit.Message))
+		}
+		link := e.Project.WebURL
+		if len(e.Commits) > 0 {
+			link = e.Commits[len(e.Commits)-1].URL
+		}
+		return adapterMessage(title+"push 到 "+ref, strings.Join(lines, "\n"), link, project), nil
+	case "merge_request":
+		return adapterMessage(title+"MR !"+strconv.Itoa(attrs.IID)+" "+attrs.Action, user+": "+attrs.Title, attrs.URL, project), nil
+	case "issue":
+		return adapterMessage(title+"Issue #"+strconv.Itoa(attrs.IID)+" "+attrs.Action, user+": "+attrs.Title, attrs.URL, project), nil
+	case "note":
+		return adapterMessage(title+attrs.NoteableType+" 新评论", user+": "+attrs.Note, attrs.URL, project), nil
+	case "pipeline":
+		// 只通知结束的流水线
+		switch attrs.Status {
+		case "success", "failed", "canceled":
+		default:
+			return nil, nil
+		}
+		return adapterMessage(title+"Pipeline "+attrs.Status, attrs.Ref+" 上的流水线 #"+strconv.Itoa(attrs.ID)+" "+attrs.Status,
+			e.Project.WebURL+"/-/pipelines/"+strconv.Itoa(attrs.ID), project), nil
+	case "release":
+		if e.Action != "create" {
+			return nil, nil
+		}
+		return adapterMessage(title+"发布 "+e.Tag, "发布了 "+e.Name, e.URL, project), nil
+	}
+	return adapterMessage(title+e.ObjectKind, user+" 触发了 "+e.ObjectKind, e.Project.WebURL, project), nil
+}
+
+// Grafana 的告警 webhook 在 Alertmanager 的格式上增加了 title 和 message
+type grafanaAdapter struct{}
+
+func (grafanaAdapter) Name() string {
+	return "grafana"
+}
+
+// Grafana 11 起可以给 webhook 配置 HMAC 签名，旧版本可以把密钥设置为 Authorization 的 Bearer token
+func (grafanaAdapter) Verify(r *http.Request, body []byte, secret string) error {
+	if signature := r.Header.Get("X-Grafana-Alerting-Signature"); len(signature) > 0 {
+		// 配置了时间戳头时，签名内容为 "时间戳:body"
+		if timestamp := r.Header.Get("X-Grafana-Alerting-Signature-Timestamp"); len(timestamp) > 0 {
+			body = append([]byte(timestamp+":"), body...)
+		}
+		return verifyHMAC(signature, body, secret)
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+secret)) != 1 {
+		return errors.New("缺少签名或 Authorization 不正确")
+	}
+	return nil
+}
+
+func (grafanaAdapter) Translate(r *http.Request, body []byte) (*Message, error) {
+	var p struct {
+		alertmanagerPayload
+		Title string `json:"title"`
+	}
+	if err := json.Unmarshal(body, &p); err != nil || len(p.Status) == 0 {
+		return nil, errors.New("Grafana webhook 格式不正确")
+	}
+	text, firing := alertmanagerBody(&p.alertmanagerPayload)
+	title := p.Title
+	if len(title) == 0 {
+		title = alertmanagerTitle(&p.alertmanagerPayload, firing)
+	}
+	sum := sha256.Sum256([]byte(p.GroupKey))
+	group := "grafana-" + hex.EncodeToString(sum[:8])
+	msg := adapterMessage(title, text, p.ExternalURL, group)
+	msg.Params["level"] = alertmanagerLevel(&p.alertmanagerPayload)
+	msg.Params["collapse_id"] = group
+	return msg, nil
+}
+
+// Slack incoming webhook 的 {"text": ...}，也兼容只有 attachments 的请求
+type slackAdapter struct{}
+
+func (slackAdapter) Name() string {
+	return "slack"
+}
+
+// Slack 的链接格式 <url|文字> 和 <url>
+var slackLink = regexp.MustCompile(`<([^|>]+)(?:\|([^>]*))?>`)
+
+func slackText(s string) string {
+	s = slackLink.ReplaceAllStringFunc(s, func(m string) string {
+		parts := slackLink.FindStringSubmatch(m)
+		if len(parts[2]) > 0 {
+			return parts[2]
+		}
+		return parts[1]
+	})
+	return strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&").Replace(s)
+}
+
+func (slackAdapter) Translate(r *http.Request, body []byte) (*Message, error) {
+	var p struct {
+		Text        string `json:"text"`
+		Username    string `json:"username"`
+		IconURL     string `json:"icon_url"`
+		Attachments []struct {
+			Fallback  string `json:"fallback"`
+			Pretext   string `json:"pretext"`
+			Title     string `json:"title"`
+			TitleLink string `json:"title_link"`
+			Text      string `json:"text"`
+		} `json:"attachments"`
+	}
+	// 有的客户端以表单 payload=... 发送
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if values, err := url.ParseQuery(string(body)); err == nil && len(values.Get("payload")) > 0 {
+			body = []byte(values.Get("payload"))
+		}
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, errors.New("Slack webhook 格式不正确")
+	}
+
+	title := p.Username
+	lines := []string{}
+	if len(p.Text) > 0 {
+		lines = append(lines, slackText(p.Text))
+	}
+	link := ""
+	for _, a := range p.Attachments {
+		if len(title) == 0 && len(a.Title) > 0 {
+			title = slackText(a.Title)
+		}
+		if len(link) == 0 {
+			link = a.TitleLink
+		}
+		for _, s := range []string{a.Pretext, a.Text} {
+			if len(s) > 0 {
+				lines = append(lines, slackText(s))
+			}
+		}
+		if len(a.Pretext) == 0 && len(a.Text) == 0 && len(a.Fallback) > 0 {
+			lines = append(lines, slackText(a.Fallback))
+		}
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("Slack webhook 缺少 text")
+	}
+	if len(link) == 0 {
+		if m := slackLink.FindStringSubmatch(p.Text); m != nil && strings.HasPrefix(m[1], "http") {
+			link = m[1]
+		}
+	}
+	msg := adapterMessage(title, strings.Join(lines, "\n"), link, "")
+	if len(p.IconURL) > 0 {
+		msg.Params["icon"] = p.IconURL
+	}
+	return msg, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-zoo/bone"
+)
+
+// Alertmanager webhook 的请求体，只保留用到的字段
+type alertmanagerPayload struct {
+	Version           string            `json:"version"`
+	GroupKey          string            `json:"groupKey"`
+	TruncatedAlerts   int               `json:"truncatedAlerts"`
+	Status            string            `json:"status"`
+	Receiver          string            `json:"receiver"`
+	GroupLabels       map[string]string `json:"groupLabels"`
+	CommonLabels      map[string]string `json:"commonLabels"`
+	CommonAnnotations map[string]string `json:"commonAnnotations"`
+	ExternalURL       string            `json:"externalURL"`
+	Alerts            []struct {
+		Status       string            `json:"status"`
+		Labels       map[string]string `json:"labels"`
+		Annotations  map[string]string `json:"annotations"`
+		GeneratorURL string            `json:"generatorURL"`
+	} `json:"alerts"`
+}
+
+// 通知正文最多列出的告警条数
+const alertmanagerMaxLines = 5
+
+// 按 severity 标签决定通知的打扰程度，已恢复的告警不打扰
+var alertmanagerLevels = map[string]string{
+	"critical": "timeSensitive",
+	"page":     "timeSensitive",
+	"error":    "timeSensitive",
+	"warning":  "active",
+	"info":     "passive",
+	"none":     "passive",
+}
+
+func alertmanagerLevel(p *alertmanagerPayload) string {
+	if p.Status == "resolved" {
+		return "passive"
+	}
+	level := "active"
+	rank := map[string]int{"passive": 0, "active": 1, "timeSensitive": 2}
+	found := false
+	for _, alert := range p.Alerts {
+		if alert.Status != "firing" {
+			continue
+		}
+		l, ok := alertmanagerLevels[strings.ToLower(alert.Labels["severity"])]
+		if !ok {
+			continue
+		}
+		if !found || rank[l] > rank[level] {
+			level = l
+			found = true
+		}
+	}
+	return level
+}
+
+// 标题类似 Alertmanager 默认模板：[FIRING:2] HighCPU job=node
+func alertmanagerTitle(p *alertmanagerPayload, firing int) string {
+	title := "[RESOLVED]"
+	if p.Status == "firing" {
+		title = "[FIRING:" + strconv.Itoa(firing) + "]"
+	}
+	if name := p.GroupLabels["alertname"]; len(name) > 0 {
+		title += " " + name
+	}
+	names := make([]string, 0, len(p.GroupLabels))
+	for name := range p.GroupLabels {
+		if name != "alertname" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		title += " " + name + "=" + p.GroupLabels[name]
+	}
+	return title
+}
+
+// 每条告警一行，优先使用 summary，其次 description，都没有时使用 alertname 和 instance
+func alertmanagerLine(labels map[string]string, annotations map[string]string) string {
+	if s := annotations["summary"]; len(s) > 0 {
+		return s
+	}
+	if s := annotations["description"]; len(s) > 0 {
+		return s
+	}
+	line := labels["alertname"]
+	if instance := labels["instance"]; len(instance) > 0 {
+		line += " " + instance
+	}
+	return line
+}
+
+func alertmanagerBody(p *alertmanagerPayload) (string, int) {
+	var firing, resolved []string
+	for _, alert := range p.Alerts {
+		line := alertmanagerLine(alert.Labels, alert.Annotations)
+		if alert.Status == "firing" {
+			firing = append(firing, line)
+		} else {
+			resolved = append(resolved, line)
+		}
+	}
+
+	var lines []string
+	add := func(prefix string, items []string) {
+		for i, item := range items {
+			if i == alertmanagerMaxLines {
+				lines = append(lines, "…还有 "+strconv.Itoa(len(items)-i)+" 条")
+				break
+			}
+			lines = append(lines, prefix+item)
+		}
+	}
+	// 混合状态时才需要区分前缀
+	if len(firing) > 0 && len(resolved) > 0 {
+		add("[触发] ", firing)
+		add("[恢复] ", resolved)
+	} else {
+		add("", firing)
+		add("", resolved)
+	}
+	if p.TruncatedAlerts > 0 {
+		lines = append(lines, "另有 "+strconv.Itoa(p.TruncatedAlerts)+" 条告警被截断")
+	}
+	return strings.Join(lines, "\n"), len(firing) + p.TruncatedAlerts
+}
+
+// POST /alertmanager/:target，target 为 key 或 ntfy 的 topic，带 dry_run=1 时只预览不推送。
+// groupKey 作为 thread-id 和 collapse-id，同一组告警的后续通知会替换之前的通知
+func alertmanagerReceiver(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	target := bone.GetValue(r, "target")
+	logger := requestLogger(r).With(secret("target", redactKey, target))
+
+	keys := getTopicKeys(target)
+	if len(keys) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, responseString(404, "找不到对应的key或topic"))
+		return
+	}
+
+	p := &alertmanagerPayload{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(p); err != nil || len(p.Status) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, responseString(400, "不是有效的 Alertmanager webhook 请求"))
+		return
+	}
+
+	body, firing := alertmanagerBody(p)
+	if len(body) == 0 {
+		body = "无告警内容"
+	}
+	sum := sha256.Sum256([]byte(p.GroupKey))
+	group := "alertmanager-" + hex.EncodeToString(sum[:8])
+	params := map[string]interface{}{
+		"level":       alertmanagerLevel(p),
+		"group":       group,
+		"collapse_id": group,
+	}
+	if len(p.ExternalURL) > 0 {
+		params["url"] = p.ExternalURL
+	}
+	msg := &Message{Title: alertmanagerTitle(p, firing), Body: body, Params: params}
+
+	logger.Debug("收到Alertmanager告警", "status", p.Status, "alerts", len(p.Alerts), "receiver", p.Receiver)
+	if isDryRun(r) {
+		writeKeysPreview(w, keys, msg)
+		return
+	}
+	// Alertmanager 会对 5xx 和 429 重试
+	if err := pushToKeys(r.Context(), keys, clientIP(r), msg); err != nil {
+		if e, ok := err.(*limitError); ok {
+			writeLimited(w, e)
+			return
+		}
+		logger.Warn("推送失败", "err", err)
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, responseString(502, err.Error()))
+		return
+	}
+	logger.Info("推送成功", "status", p.Status, "alerts", len(p.Alerts))
+	fmt.Fprint(w, responseString(200, ""))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-zoo/bone"
+)
+
+// 用 dry_run 预览 APNs 请求，返回第一个设备的 aps 字典
+func previewAPS(t *testing.T, handler http.Handler, url string, body string) map[string]interface{} {
+	t.Helper()
+	req := httptest.NewRequest("POST", url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	resp := struct {
+		Code int `json:"code"`
+		Data []struct {
+			Payload struct {
+				APS map[string]interface{} `json:"aps"`
+			} `json:"payload"`
+		} `json:"data"`
+		Message string `json:"message"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s: %v", rec.Body.String(), err)
+	}
+	if resp.Code != 200 || len(resp.Data) != 1 {
+		t.Fatalf("preview = %s", rec.Body.String())
+	}
+	return resp.Data[0].Payload.APS
+}
+
+func TestAlertmanagerInterruptionLevel(t *testing.T) {
+	openTestDB(t)
+	key := "alertTestKey01"
+	if err := saveDevice(key, Device{Provider: "apns", Token: strings.Repeat("ab", 32)}); err != nil {
+		t.Fatal(err)
+	}
+	mux := bone.New()
+	mux.Post("/alertmanager/:target", http.HandlerFunc(alertmanagerReceiver))
+
+	cases := []struct {
+		status   string
+		severity string
+		want     string
+	}{
+		{"firing", "critical", "time-sensitive"},
+		{"firing", "warning", "active"},
+		{"firing", "info", "passive"},
+		{"firing", "", "active"},
+		{"resolved", "critical", "passive"},
+	}
+	for _, c := range cases {
+		body := `{"version":"4","groupKey":"{}:{alertname=\"HighCPU\"}","status":"` + c.status + `","alerts":[` +
+			`{"status":"` + c.status + `","labels":{"alertname":"HighCPU","severity":"` + c.severity + `"},"annotations":{"summary":"CPU 过高"}}]}`
+		aps := previewAPS(t, mux, "/alertmanager/"+key+"?dry_run=1", body)
+		if aps["interruption-level"] != c.want {
+			t.Errorf("%s %s: interruption-level = %v, want %s", c.status, c.severity, aps["interruption-level"], c.want)
+		}
+	}
+}
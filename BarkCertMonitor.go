@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var certExpiry = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "bark_apns_certificate_expiry_timestamp_seconds",
+	Help: "Expiry time of the loaded APNs certificate as a unix timestamp.",
+}, func() float64 {
+	cert := currentCert()
+	if cert == nil {
+		return 0
+	}
+	return float64(cert.NotAfter.Unix())
+})
+
+var certExpired = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "bark_apns_certificate_expired",
+	Help: "Whether the loaded APNs certificate has expired (1) or not (0).",
+}, func() float64 {
+	if cert := currentCert(); cert != nil && time.Now().After(cert.NotAfter) {
+		return 1
+	}
+	return 0
+})
+
+func init() {
+	prometheus.MustRegister(certExpiry, certExpired)
+}
+
+func certDaysLeft(cert *x509.Certificate) int {
+	return int(time.Until(cert.NotAfter).Hours() / 24)
+}
+
+// 每天检查一次推送证书的有效期，剩余天数不超过 warnDays 时输出警告，并推送给 adminKeys
+func monitorCertificate(warnDays int, adminKeys []string) {
+	check := func() {
+		cert := currentCert()
+		if cert == nil {
+			return
+		}
+		days := certDaysLeft(cert)
+		expires := cert.NotAfter.Format("2006-01-02 15:04:05")
+		if days > warnDays {
+			slog.Debug("推送证书有效", "expires_at", expires, "days_left", days)
+			return
+		}
+		title := "Bark 推送证书即将过期"
+		body := "证书 " + cert.Subject.CommonName + " 将于 " + expires + " 过期，剩余 " + strconv.Itoa(days) + " 天"
+		if time.Now().After(cert.NotAfter) {
+			title = "Bark 推送证书已过期"
+			body = "证书 " + cert.Subject.CommonName + " 已于 " + expires + " 过期"
+		}
+		slog.Warn(title, "subject", cert.Subject.CommonName, "expires_at", expires, "days_left", days)
+
+		for _, key := range adminKeys {
+			msg := &Message{Title: title, Body: body}
+			if err := pushToKey(context.Background(), key, msg); err != nil {
+				slog.Warn("发送证书过期提醒失败", secret("key", redactKey, key), "err", err)
+			}
+		}
+	}
+
+	check()
+	for range time.Tick(24 * time.Hour) {
+		check()
+	}
+}
+
+func splitKeys(keys string) []string {
+	var result []string
+	for _, key := range strings.Split(keys, ",") {
+		if key = strings.TrimSpace(key); len(key) > 0 {
+			result = append(result, key)
+		}
+	}
+	return result
+}
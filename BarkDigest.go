@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-zoo/bone"
+)
+
+// 合并窗口，保存在 key 的 KeyMeta 中，也可以在单次推送中用 digest、digest_count 参数指定。
+// 窗口内同一 group（没有 group 时按标题）的推送合并成一条发出，
+// 窗口到期或攒够 MaxCount 条时发送，MaxCount 为 0 时只按时间发送
+type DigestConfig struct {
+	Window   int `json:"window"`
+	MaxCount int `json:"max_count"`
+}
+
+// 窗口最长一小时；每个窗口最多攒的条数，超过后立即发送
+const (
+	digestMaxWindow = 3600
+	digestMaxCount  = 100
+)
+
+// 合并后的推送中最多列出的条数
+const digestSummaryLines = 10
+
+// 合并的推送发送失败时的最多尝试次数，间隔 30s、1m、2m ...
+const digestMaxAttempts = 5
+
+type digestBatch struct {
+	key     string
+	group   string
+	msgs    []*Message
+	timer   *time.Timer
+	attempt int
+}
+
+var digestMu sync.Mutex
+var digestBatches = map[string]*digestBatch{}
+
+// 发送失败、等待重试的窗口；停止服务后不再重试
+var digestRetries = map[*digestBatch]bool{}
+var digestClosed bool
+
+// 秒数或者 time.ParseDuration 能识别的时长，例如 60、90s、5m
+func parseDigestWindow(s string) (int, error) {
+	seconds, err := strconv.Atoi(s)
+	if err != nil {
+		d, e := time.ParseDuration(s)
+		if e != nil {
+			return 0, errors.New("digest 应为秒数或者时长，例如 60、5m")
+		}
+		seconds = int(d / time.Second)
+	}
+	if seconds <= 0 || seconds > digestMaxWindow {
+		return 0, errors.New("digest 应在 1 秒到 1 小时之间")
+	}
+	return seconds, nil
+}
+
+func (c *DigestConfig) validate() error {
+	if c.Window <= 0 || c.Window > digestMaxWindow {
+		return errors.New("window 应在 1 秒到 1 小时之间")
+	}
+	if c.MaxCount < 0 || c.MaxCount > digestMaxCount {
+		return errors.New("max_count 应在 0 到 " + strconv.Itoa(digestMaxCount) + " 之间")
+	}
+	return nil
+}
+
+// 取出本次推送的合并设置，推送参数优先于 key 的设置；返回去掉了 digest 参数的消息
+func digestOptions(key string, msg *Message) (*DigestConfig, *Message, error) {
+	window, hasWindow := msg.Params["digest"]
+	count, hasCount := msg.Params["digest_count"]
+	if hasWindow || hasCount {
+		params := map[string]interface{}{}
+		for name, value := range msg.Params {
+			if name != "digest" && name != "digest_count" {
+				params[name] = value
+			}
+		}
+		copied := *msg
+		copied.Params = params
+		msg = &copied
+	}
+
+	var config *DigestConfig
+	if hasWindow {
+		seconds, err := parseDigestWindow(fmt.Sprint(window))
+		if err != nil {
+			return nil, msg, err
+		}
+		config = &DigestConfig{Window: seconds}
+	} else if meta, err := getKeyMeta(key); err == nil && meta.Digest != nil {
+		c := *meta.Digest
+		config = &c
+	}
+	if config != nil && hasCount {
+		num, err := strconv.Atoi(fmt.Sprint(count))
+		if err != nil {
+			return nil, msg, errors.New("digest_count 必须是整数")
+		}
+		config.MaxCount = num
+	}
+	if config != nil {
+		if err := config.validate(); err != nil {
+			return nil, msg, err
+		}
+	}
+	return config, msg, nil
+}
+
+func digestGroup(msg *Message) string {
+	if group, ok := msg.Params["group"].(string); ok && len(group) > 0 {
+		return group
+	}
+	return msg.Title
+}
+
+// 在 pushToKey 中调用：返回去掉 digest 参数后的消息，digested 为 true 时消息已放进合并窗口，不需要发送。
+// critical 的推送不合并
+func applyDigest(key string, msg *Message) (*Message, bool) {
+	config, msg, err := digestOptions(key, msg)
+	logger := slog.Default().With(secret("key", redactKey, key))
+	if err != nil {
+		logger.Warn("合并设置不正确，直接发送", "err", err)
+		return msg, false
+	}
+	if config == nil || messageLevel(msg) == "critical" {
+		return msg, false
+	}
+
+	group := digestGroup(msg)
+	id := key + "\x00" + group
+	maxCount := config.MaxCount
+	if maxCount == 0 {
+		maxCount = digestMaxCount
+	}
+
+	digestMu.Lock()
+	batch, ok := digestBatches[id]
+	if !ok {
+		batch = &digestBatch{key: key, group: group}
+		batch.timer = time.AfterFunc(time.Duration(config.Window)*time.Second, func() {
+			if takeDigest(id, batch) {
+				flushDigest(context.Background(), batch)
+			}
+		})
+		digestBatches[id] = batch
+	}
+	batch.msgs = append(batch.msgs, msg)
+	count := len(batch.msgs)
+	full := count >= maxCount
+	if full {
+		batch.timer.Stop()
+		delete(digestBatches, id)
+	}
+	digestMu.Unlock()
+
+	logger.Debug("推送已放进合并窗口", "group", group, "count", count)
+	if full {
+		go flushDigest(context.Background(), batch)
+	}
+	return msg, true
+}
+
+// 把到期的窗口从 digestBatches 中取出，已经因为攒够条数发送过的返回 false
+func takeDigest(id string, batch *digestBatch) bool {
+	digestMu.Lock()
+	defer digestMu.Unlock()
+	if digestBatches[id] != batch {
+		return false
+	}
+	delete(digestBatches, id)
+	return true
+}
+
+// 只有一条时原样发送，多条时合并成一条，level 取其中最高的
+func digestMessage(batch *digestBatch) *Message {
+	if len(batch.msgs) == 1 {
+		return batch.msgs[0]
+	}
+
+	var lines []string
+	counts := map[string]int{}
+	level := "passive"
+	for _, msg := range batch.msgs {
+		line := msg.Body
+		if len(msg.Title) > 0 && msg.Title != batch.group {
+			line = msg.Title + ": " + line
+		}
+		line = truncate(firstLine(line), 80)
+		if counts[line] == 0 {
+			lines = append(lines, line)
+		}
+		counts[line]++
+		if levelRank[messageLevel(msg)] > levelRank[level] {
+			level = messageLevel(msg)
+		}
+	}
+
+	var body []string
+	for i, line := range lines {
+		if i == digestSummaryLines {
+			body = append(body, "…还有 "+strconv.Itoa(len(lines)-i)+" 条")
+			break
+		}
+		if counts[line] > 1 {
+			line += " ×" + strconv.Itoa(counts[line])
+		}
+		body = append(body, line)
+	}
+
+	title := strconv.Itoa(len(batch.msgs)) + " 条通知"
+	if len(batch.group) > 0 {
+		title = strconv.Itoa(len(batch.msgs)) + " 条来自 " + batch.group + " 的通知"
+	}
+	last := batch.msgs[len(batch.msgs)-1]
+	params := map[string]interface{}{}
+	for name, value := range last.Params {
+		params[name] = value
+	}
+	params["level"] = level
+	if len(batch.group) > 0 {
+		params["group"] = batch.group
+	}
+	return &Message{Category: last.Category, Title: title, Body: strings.Join(body, "\n"), Params: params}
+}
+
+// 发送失败时保留这批推送，稍后重试，超过次数后才放弃
+func flushDigest(ctx context.Context, batch *digestBatch) {
+	logger := slog.Default().With(secret("key", redactKey, batch.key))
+	batch.attempt++
+	err := deliverToKey(ctx, batch.key, digestMessage(batch))
+	if err == nil {
+		logger.Info("已发送合并的推送", "group", batch.group, "count", len(batch.msgs))
+		return
+	}
+
+	digestMu.Lock()
+	defer digestMu.Unlock()
+	if batch.attempt >= digestMaxAttempts || digestClosed || !keyExists(batch.key) {
+		logger.Error("发送合并的推送失败，已放弃", "group", batch.group, "count", len(batch.msgs), "attempt", batch.attempt, "err", err)
+		return
+	}
+	backoff := time.Duration(1<<uint(batch.attempt-1)) * 30 * time.Second
+	logger.Warn("发送合并的推送失败，稍后重试", "group", batch.group, "count", len(batch.msgs), "attempt", batch.attempt, "retry_after", backoff, "err", err)
+	digestRetries[batch] = true
+	batch.timer = time.AfterFunc(backoff, func() {
+		digestMu.Lock()
+		retry := digestRetries[batch]
+		delete(digestRetries, batch)
+		digestMu.Unlock()
+		if retry {
+			flushDigest(context.Background(), batch)
+		}
+	})
+}
+
+// 停止服务时发送所有还没到期和等待重试的窗口
+func flushAllDigests(ctx context.Context) {
+	digestMu.Lock()
+	digestClosed = true
+	batches := []*digestBatch{}
+	for _, batch := range digestBatches {
+		batches = append(batches, batch)
+	}
+	for batch := range digestRetries {
+		batches = append(batches, batch)
+	}
+	digestBatches = map[string]*digestBatch{}
+	digestRetries = map[*digestBatch]bool{}
+	digestMu.Unlock()
+	for _, batch := range batches {
+		batch.timer.Stop()
+		flushDigest(ctx, batch)
+	}
+}
+
+func pendingDigests(key string) int {
+	digestMu.Lock()
+	defer digestMu.Unlock()
+	total := 0
+	for _, batch := range digestBatches {
+		if len(key) == 0 || batch.key == key {
+			total += len(batch.msgs)
+		}
+	}
+	for batch := range digestRetries {
+		if len(key) == 0 || batch.key == key {
+			total += len(batch.msgs)
+		}
+	}
+	return total
+}
+
+func startDigest() {
+	registerQueue("digest", func() int { return pendingDigests("") })
+	onShutdown(flushAllDigests)
+}
+
+// GET 查看、POST 设置、DELETE 取消 key 的合并窗口，POST 参数为 window（秒数或时长）和 max_count
+func digestSettings(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	key := bone.GetValue(r, "key")
+	if !keyExists(key) {
+		fmt.Fprint(w, responseString(400, "找不到key对应的DeviceToken, 请确保Key正确! Key可在App端注册获得。"))
+		return
+	}
+
+	var meta *KeyMeta
+	var err error
+	switch r.Method {
+	case "POST", "PUT":
+		config := &DigestConfig{}
+		if config.Window, err = parseDigestWindow(r.FormValue("window")); err != nil {
+			fmt.Fprint(w, responseString(400, strings.Replace(err.Error(), "digest", "window", 1)))
+			return
+		}
+		if count := r.FormValue("max_count"); len(count) > 0 {
+			if config.MaxCount, err = strconv.Atoi(count); err != nil {
+				fmt.Fprint(w, responseString(400, "max_count 必须是整数"))
+				return
+			}
+		}
+		if err := config.validate(); err != nil {
+			fmt.Fprint(w, responseString(400, err.Error()))
+			return
+		}
+		meta, err = updateKeyMeta(key, func(meta *KeyMeta) error {
+			meta.Digest = config
+			return nil
+		})
+	case "DELETE":
+		meta, err = updateKeyMeta(key, func(meta *KeyMeta) error {
+			meta.Digest = nil
+			return nil
+		})
+	default:
+		meta, err = getKeyMeta(key)
+	}
+	if err != nil {
+		fmt.Fprint(w, responseString(500, err.Error()))
+		return
+	}
+	fmt.Fprint(w, responseData(200, map[string]interface{}{
+		"digest":  meta.Digest,
+		"pending": pendingDigests(key),
+	}, ""))
+}
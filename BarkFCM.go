@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// Firebase Cloud Messaging HTTP v1 接口，使用服务账号获取 OAuth2 token
+type fcmProvider struct {
+	url    string
+	client *http.Client
+}
+
+// endpoint 默认为 https://fcm.googleapis.com，测试时可以指向本地的模拟服务；
+// token 的获取地址使用服务账号文件中的 token_uri
+func newFCMProvider(credentialsFile string, endpoint string) (*fcmProvider, error) {
+	data, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	creds, err := google.CredentialsFromJSON(ctx, data, "https://www.googleapis.com/auth/firebase.messaging")
+	if err != nil {
+		return nil, err
+	}
+	if len(creds.ProjectID) == 0 {
+		return nil, errors.New("服务账号文件中没有 project_id")
+	}
+	if len(endpoint) == 0 {
+		endpoint = "https://fcm.googleapis.com"
+	}
+	client := oauth2.NewClient(ctx, creds.TokenSource)
+	client.Timeout = 30 * time.Second
+	return &fcmProvider{
+		url:    strings.TrimRight(endpoint, "/") + "/v1/projects/" + creds.ProjectID + "/messages:send",
+		client: client,
+	}, nil
+}
+
+func (p *fcmProvider) Name() string {
+	return "fcm"
+}
+
+func (p *fcmProvider) ValidateTarget(token string) error {
+	if len(token) < 32 || strings.ContainsAny(token, " \t\r\n") {
+		return errors.New("FCM registration token 格式不正确")
+	}
+	return nil
+}
+
+type fcmMessage struct {
+	Token        string            `json:"token"`
+	Notification map[string]string `json:"notification,omitempty"`
+	Data         map[string]string `json:"data,omitempty"`
+	Android      map[string]string `json:"android,omitempty"`
+}
+
+type fcmErrorResponse struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+		Details []struct {
+			Type      string `json:"@type"`
+			ErrorCode string `json:"errorCode"`
+		} `json:"details"`
+	} `json:"error"`
+}
+
+func (p *fcmProvider) Send(ctx context.Context, token string, msg *Message) error {
+	message := fcmMessage{
+		Token:        token,
+		Notification: map[string]string{"body": msg.Body},
+		Data:         map[string]string{},
+		Android:      map[string]string{"priority": "high"},
+	}
+	if len(msg.Title) > 0 {
+		message.Notification["title"] = msg.Title
+	}
+	// data 只允许字符串
+	for key, value := range msg.Params {
+		message.Data[key] = fmt.Sprint(value)
+	}
+	if len(msg.Category) > 0 {
+		message.Data["category"] = msg.Category
+	}
+	if collapseID, ok := msg.Params["collapse_id"].(string); ok && len(collapseID) > 0 {
+		message.Android["collapse_key"] = collapseID
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"message": message})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return &PushError{Message: "与FCM服务器传输数据失败", Reason: "TransportError"}
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var errRes fcmErrorResponse
+	data, _ := ioutil.ReadAll(res.Body)
+	json.Unmarshal(data, &errRes)
+	reason := errRes.Error.Status
+	for _, detail := range errRes.Error.Details {
+		if len(detail.ErrorCode) > 0 {
+			reason = detail.ErrorCode
+		}
+	}
+	if len(reason) == 0 {
+		reason = http.StatusText(res.StatusCode)
+	}
+
+	e := &PushError{Message: "推送发送失败 " + reason, Reason: reason}
+	switch {
+	case reason == "UNREGISTERED" || reason == "SENDER_ID_MISMATCH" ||
+		res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone:
+		e.Permanent = true
+		e.Invalid = true
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+	default:
+		e.Permanent = true
+	}
+	return e
+}
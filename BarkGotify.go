@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/go-zoo/bone"
+)
+
+// Gotify 的应用 token，对应一个 Bark key，保存在 gotify bucket 中，以 token 为键
+type gotifyApp struct {
+	ID        uint64    `json:"id"`
+	Token     string    `json:"token"`
+	Key       string    `json:"key"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const gotifyMaxPerKey = 20
+
+// Gotify 的应用 token 以 A 开头，共 15 位
+func newGotifyToken() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return "A" + token[:14]
+}
+
+func listGotifyApps(key string) ([]gotifyApp, error) {
+	apps := []gotifyApp{}
+	err := boltDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("gotify"))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var app gotifyApp
+			if err := json.Unmarshal(v, &app); err != nil {
+				return err
+			}
+			if app.Key == key {
+				apps = append(apps, app)
+			}
+			return nil
+		})
+	})
+	return apps, err
+}
+
+// 找不到映射时，token 本身是已注册的 key 也可以直接使用
+func getGotifyApp(token string) (*gotifyApp, bool) {
+	var app *gotifyApp
+	boltDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("gotify"))
+		if bucket == nil {
+			return nil
+		}
+		if val := bucket.Get([]byte(token)); val != nil {
+			app = &gotifyApp{}
+			return json.Unmarshal(val, app)
+		}
+		return nil
+	})
+	if app != nil && keyExists(app.Key) {
+		return app, true
+	}
+	if len(token) > 0 && keyExists(token) {
+		return &gotifyApp{Token: token, Key: token}, true
+	}
+	return nil, false
+}
+
+// Gotify 客户端会检查 HTTP 状态码，错误使用 Gotify 的格式返回
+func gotifyError(w http.ResponseWriter, code int, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	data, _ := json.Marshal(map[string]interface{}{
+		"error":            http.StatusText(code),
+		"errorCode":        code,
+		"errorDescription": description,
+	})
+	fmt.Fprint(w, string(data))
+}
+
+type gotifyMessage struct {
+	ID       int64                  `json:"id"`
+	AppID    uint64                 `json:"appid"`
+	Message  string                 `json:"message"`
+	Title    string                 `json:"title"`
+	Priority int                    `json:"priority"`
+	Extras   map[string]interface{} `json:"extras,omitempty"`
+	Date     time.Time              `json:"date"`
+}
+
+// 按 Gotify 的习惯，0-3 不打扰，4-7 普通，8 以上为时效性通知
+func gotifyLevel(priority int) string {
+	switch {
+	case priority <= 3:
+		return "passive"
+	case priority <= 7:
+		return "active"
+	default:
+		return "timeSensitive"
+	}
+}
+
+// 把 Gotify 的消息转换成 Bark 的推送参数，extras 中只取点击跳转和大图
+func gotifyParams(app *gotifyApp, m *gotifyMessage) map[string]interface{} {
+	params := map[string]interface{}{
+		"level":    gotifyLevel(m.Priority),
+		"priority": strconv.Itoa(m.Priority),
+	}
+	if len(app.Name) > 0 {
+		params["group"] = app.Name
+	}
+	notification, _ := m.Extras["client::notification"].(map[string]interface{})
+	if click, ok := notification["click"].(map[string]interface{}); ok {
+		if u, ok := click["url"].(string); ok && len(u) > 0 {
+			params["url"] = u
+		}
+	}
+	if image, ok := notification["bigImageUrl"].(string); ok && len(image) > 0 {
+		params["image"] = image
+	}
+	return params
+}
+
+func gotifyToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); len(token) > 0 {
+		return token
+	}
+	if token := r.Header.Get("X-Gotify-Key"); len(token) > 0 {
+		return token
+	}
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// POST /message，兼容 Gotify 的推送接口，支持 JSON 和表单
+func gotifyPush(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	app, ok := getGotifyApp(gotifyToken(r))
+	if !ok {
+		gotifyError(w, http.StatusUnauthorized, "you need to provide a valid access token or user credentials to access this api")
+		return
+	}
+	logger := requestLogger(r).With(secret("key", redactKey, app.Key))
+
+	// 与 Gotify 一样，没有指定优先级时为 0
+	m := &gotifyMessage{}
+	r.Body = io.NopCloser(io.LimitReader(r.Body, 1<<16))
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(m); err != nil {
+			gotifyError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	} else {
+		m.Title = r.FormValue("title")
+		m.Message = r.FormValue("message")
+		if p, err := strconv.Atoi(r.FormValue("priority")); err == nil {
+			m.Priority = p
+		}
+	}
+	if len(m.Message) == 0 {
+		gotifyError(w, http.StatusBadRequest, "Field 'message' is required")
+		return
+	}
+	if len(m.Title) == 0 {
+		m.Title = app.Name
+	}
+
+	if e := checkLimit(app.Key, clientIP(r)); e != nil {
+		logger.Warn("推送被限制", "reason", e.Message, "retry_after", e.RetryAfter)
+		writeLimited(w, e)
+		return
+	}
+
+	logger.Debug("收到Gotify推送", secret("title", redactBody, m.Title), secret("body", redactBody, m.Message), "priority", m.Priority)
+	err := pushToKey(r.Context(), app.Key, &Message{Title: m.Title, Body: m.Message, Params: gotifyParams(app, m)})
+	if err != nil {
+		logger.Warn("推送失败", "err", err)
+		gotifyError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	logger.Info("推送成功")
+
+	m.AppID = app.ID
+	m.Date = time.Now()
+	m.ID = m.Date.UnixMilli()
+	data, _ := json.Marshal(m)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(data))
+}
+
+// GET 列出 key 的 Gotify 应用，POST 新建一个应用 token，name 会作为默认标题和分组
+func gotifyApps(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	key := bone.GetValue(r, "key")
+	if !keyExists(key) {
+		fmt.Fprint(w, responseString(400, "找不到key对应的DeviceToken, 请确保Key正确! Key可在App端注册获得。"))
+		return
+	}
+
+	if r.Method == "POST" {
+		r.ParseForm()
+		app := gotifyApp{Token: newGotifyToken(), Key: key, Name: r.FormValue("name"), CreatedAt: time.Now()}
+		full := false
+		err := boltDB.Update(func(tx *bolt.Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists([]byte("gotify"))
+			if err != nil {
+				return err
+			}
+			count := 0
+			bucket.ForEach(func(k, v []byte) error {
+				var other gotifyApp
+				if json.Unmarshal(v, &other) == nil && other.Key == key {
+					count++
+				}
+				return nil
+			})
+			if count >= gotifyMaxPerKey {
+				full = true
+				return nil
+			}
+			app.ID, err = bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			val, err := json.Marshal(app)
+			if err != nil {
+				return err
+			}
+			return bucket.Put([]byte(app.Token), val)
+		})
+		if full {
+			fmt.Fprint(w, responseString(400, "每个key最多添加 "+strconv.Itoa(gotifyMaxPerKey)+" 个Gotify应用"))
+			return
+		}
+		if err != nil {
+			fmt.Fprint(w, responseString(500, err.Error()))
+			return
+		}
+		fmt.Fprint(w, responseData(200, app, "添加成功"))
+		return
+	}
+
+	apps, err := listGotifyApps(key)
+	if err != nil {
+		fmt.Fprint(w, responseString(500, err.Error()))
+		return
+	}
+	fmt.Fprint(w, responseData(200, apps, ""))
+}
+
+func deleteGotifyApp(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	key := bone.GetValue(r, "key")
+	token := bone.GetValue(r, "token")
+	found := false
+	err := boltDB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("gotify"))
+		if bucket == nil {
+			return nil
+		}
+		var app gotifyApp
+		val := bucket.Get([]byte(token))
+		if val == nil || json.Unmarshal(val, &app) != nil || app.Key != key {
+			return nil
+		}
+		found = true
+		return bucket.Delete([]byte(token))
+	})
+	if err != nil {
+		fmt.Fprint(w, responseString(500, err.Error()))
+		return
+	}
+	if !found {
+		fmt.Fprint(w, responseString(400, "找不到对应的Gotify应用"))
+		return
+	}
+	fmt.Fprint(w, responseString(200, "删除成功"))
+}
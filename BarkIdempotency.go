@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// 相同 Idempotency-Key 的请求在这段时间内直接返回第一次的结果，在 main 中根据参数设置
+var IdempotencyTTL = 24 * time.Hour
+
+const idempotencyKeyMaxLen = 255
+
+// 计算请求摘要时最多读取的请求体字节数
+const idempotencyMaxBody = 1 << 20
+
+// 第一次请求成功时的响应，保存在 idempotency bucket 中
+type idempotentResponse struct {
+	Status      int       `json:"status"`
+	ContentType string    `json:"content_type"`
+	Body        []byte    `json:"body"`
+	RequestHash string    `json:"request_hash"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// 正在处理中的请求，重复的请求不能同时处理
+var idempotencyMu sync.Mutex
+var idempotencyPending = map[string]bool{}
+
+type responseCapture struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (c *responseCapture) WriteHeader(code int) {
+	c.code = code
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+	c.body.Write(b)
+	return c.ResponseWriter.Write(b)
+}
+
+// 从 Idempotency-Key 请求头或 idempotency_key 参数中取出幂等键，参数会从 URL 中去掉，不会当作推送参数
+func idempotencyKey(r *http.Request) string {
+	value := r.Header.Get("Idempotency-Key")
+	query := r.URL.Query()
+	if len(value) == 0 {
+		value = query.Get("idempotency_key")
+	}
+	if _, ok := query["idempotency_key"]; ok {
+		query.Del("idempotency_key")
+		r.URL.RawQuery = query.Encode()
+	}
+	return strings.TrimSpace(value)
+}
+
+// 只有成功的结果会被保存，失败的请求重试时会重新处理
+func successful(status int, body []byte) bool {
+	if status >= 300 {
+		return false
+	}
+	resp := struct {
+		Code *int `json:"code"`
+	}{}
+	if json.Unmarshal(body, &resp) == nil && resp.Code != nil && *resp.Code != 200 {
+		return false
+	}
+	return true
+}
+
+// dry_run 只看 URL 和表单。表单从已读出的 body 中解析，不能用 r.FormValue，
+// 否则放回去的请求体会被读完，后面的处理函数拿不到表单
+func dryRunRequest(r *http.Request, body []byte) bool {
+	value := r.URL.Query().Get("dry_run")
+	if len(value) == 0 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if form, err := url.ParseQuery(string(body)); err == nil {
+			value = form.Get("dry_run")
+		}
+	}
+	return value == "1" || value == "true"
+}
+
+// 幂等键只在相同的推送目标内有效：路径中的 key 之外，还包括请求体中的 device_key(s)、topic 和 gotify 的 token
+func idempotencyID(r *http.Request, body []byte, value string) string {
+	targets := []string{r.URL.Path, gotifyToken(r)}
+	req := map[string]interface{}{}
+	if json.Unmarshal(body, &req) == nil {
+		for _, name := range []string{"device_key", "topic"} {
+			if target, ok := req[name].(string); ok {
+				targets = append(targets, name+"="+target)
+			}
+		}
+		if list, ok := req["device_keys"].([]interface{}); ok {
+			for _, item := range list {
+				if target, ok := item.(string); ok {
+					targets = append(targets, "device_keys="+target)
+				}
+			}
+		}
+	}
+	sum := sha256.Sum256([]byte(strings.Join(append(targets, value), "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// 请求的摘要，相同幂等键的请求内容不同时拒绝处理
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + "\x00" + r.URL.RawQuery + "\x00" + r.Header.Get("Content-Type") + "\x00"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// 为推送接口加上幂等键支持：相同路径、相同推送目标、相同幂等键的请求在 IdempotencyTTL 内只处理一次，
+// 之后的请求返回第一次的响应，并带上 Idempotent-Replayed: true 响应头；幂等键相同但内容不同的请求返回 422
+func idempotent(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		value := idempotencyKey(r)
+		if len(value) == 0 {
+			h(w, r)
+			return
+		}
+		// 读出请求体计算摘要，再放回去给后面的处理函数
+		body, err := io.ReadAll(io.LimitReader(r.Body, idempotencyMaxBody))
+		if err != nil {
+			fmt.Fprint(w, responseString(400, "读取请求失败"))
+			return
+		}
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		if dryRunRequest(r, body) {
+			h(w, r)
+			return
+		}
+		if len(value) > idempotencyKeyMaxLen {
+			fmt.Fprint(w, responseString(400, "Idempotency-Key 不能超过 255 个字符"))
+			return
+		}
+		logger := requestLogger(r)
+		id := idempotencyID(r, body, value)
+		hash := requestHash(r, body)
+
+		if resp, ok := getIdempotentResponse(id); ok {
+			if resp.RequestHash != hash {
+				logger.Warn("相同 Idempotency-Key 的请求内容不一致")
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				fmt.Fprint(w, responseString(422, "相同 Idempotency-Key 的请求内容不一致，请使用新的 Idempotency-Key"))
+				return
+			}
+			logger.Info("重复的请求，返回第一次的结果")
+			w.Header().Set("Content-Type", resp.ContentType)
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(resp.Status)
+			w.Write(resp.Body)
+			return
+		}
+
+		idempotencyMu.Lock()
+		if idempotencyPending[id] {
+			idempotencyMu.Unlock()
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, responseString(409, "相同 Idempotency-Key 的请求正在处理，请稍后重试"))
+			return
+		}
+		idempotencyPending[id] = true
+		idempotencyMu.Unlock()
+		defer func() {
+			idempotencyMu.Lock()
+			delete(idempotencyPending, id)
+			idempotencyMu.Unlock()
+		}()
+
+		capture := &responseCapture{ResponseWriter: w, code: http.StatusOK}
+		h(capture, r)
+		if !successful(capture.code, capture.body.Bytes()) {
+			return
+		}
+		resp := &idempotentResponse{
+			Status:      capture.code,
+			ContentType: w.Header().Get("Content-Type"),
+			Body:        capture.body.Bytes(),
+			RequestHash: hash,
+			ExpiresAt:   time.Now().Add(IdempotencyTTL),
+		}
+		if err := putIdempotentResponse(id, resp); err != nil {
+			logger.Error("保存幂等请求的结果失败", "err", err)
+		}
+	}
+}
+
+func getIdempotentResponse(id string) (*idempotentResponse, bool) {
+	resp := &idempotentResponse{}
+	found := false
+	boltDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("idempotency"))
+		if bucket == nil {
+			return nil
+		}
+		val := bucket.Get([]byte(id))
+		if val == nil {
+			return nil
+		}
+		found = json.Unmarshal(val, resp) == nil && time.Now().Before(resp.ExpiresAt)
+		return nil
+	})
+	return resp, found
+}
+
+func putIdempotentResponse(id string, resp *idempotentResponse) error {
+	val, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return boltDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("idempotency"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(id), val)
+	})
+}
+
+// 消息内容的摘要，params 的 key 在 JSON 中是排好序的
+func messageHash(msg *Message) string {
+	data, _ := json.Marshal(msg)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// key 设置了 dedup_window 时，窗口内内容完全相同的推送只发送第一条。
+// 不是重复的推送会先记下摘要，避免同时到达的相同推送都被发送，返回的 id 用于发送失败时删除摘要
+func duplicateMessage(key string, msg *Message) ([]byte, bool) {
+	meta, err := getKeyMeta(key)
+	if err != nil || meta.DedupWindow <= 0 {
+		return nil, false
+	}
+	id := []byte(key + "\x00" + messageHash(msg))
+	now := time.Now()
+	duplicate := false
+	err = boltDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("dedup"))
+		if err != nil {
+			return err
+		}
+		if val := bucket.Get(id); len(val) == 8 && now.Unix() < int64(binary.BigEndian.Uint64(val)) {
+			duplicate = true
+			return nil
+		}
+		return bucket.Put(id, seqKey(uint64(now.Unix()+int64(meta.DedupWindow))))
+	})
+	if err != nil {
+		slog.Error("记录推送摘要失败", secret("key", redactKey, key), "err", err)
+		return nil, false
+	}
+	if duplicate {
+		return nil, true
+	}
+	return id, false
+}
+
+// 推送失败时删除摘要，重试的相同推送不会被当作重复
+func forgetMessage(id []byte) {
+	if id == nil {
+		return
+	}
+	err := boltDB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("dedup"))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete(id)
+	})
+	if err != nil {
+		slog.Error("删除推送摘要失败", "err", err)
+	}
+}
+
+// 删除过期的幂等结果和推送摘要
+func cleanupIdempotency() {
+	now := time.Now()
+	err := boltDB.Update(func(tx *bolt.Tx) error {
+		var expired [][]byte
+		if bucket := tx.Bucket([]byte("idempotency")); bucket != nil {
+			bucket.ForEach(func(k, v []byte) error {
+				resp := &idempotentResponse{}
+				if json.Unmarshal(v, resp) != nil || now.After(resp.ExpiresAt) {
+					expired = append(expired, k)
+				}
+				return nil
+			})
+			for _, k := range expired {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		expired = nil
+		if bucket := tx.Bucket([]byte("dedup")); bucket != nil {
+			bucket.ForEach(func(k, v []byte) error {
+				if len(v) != 8 || now.Unix() >= int64(binary.BigEndian.Uint64(v)) {
+					expired = append(expired, k)
+				}
+				return nil
+			})
+			for _, k := range expired {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("清理过期的幂等记录失败", "err", err)
+	}
+}
+
+func runIdempotencyCleanup() {
+	for range time.Tick(10 * time.Minute) {
+		cleanupIdempotency()
+	}
+}
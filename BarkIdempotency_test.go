@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// 判断 dry_run 时不能读掉表单请求体，ntfy 和 incoming 的处理函数要读原始的请求体
+func TestIdempotentFormBody(t *testing.T) {
+	openTestDB(t)
+	var got string
+	h := idempotent(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got = string(body)
+		w.Write([]byte(responseString(200, "")))
+	})
+
+	for i, url := range []string{"/push", "/push?dry_run=1"} {
+		for j, form := range []string{"payload=%7B%22text%22%3A%22hi%22%7D", "payload=%7B%22text%22%3A%22hi%22%7D&dry_run=1"} {
+			req := httptest.NewRequest("POST", url, strings.NewReader(form))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("Idempotency-Key", "form-"+string(rune('a'+i*2+j)))
+			got = ""
+			h(httptest.NewRecorder(), req)
+			if got != form {
+				t.Errorf("%s %s: handler read body %q", url, form, got)
+			}
+		}
+	}
+}
+
+func TestDryRunRequest(t *testing.T) {
+	cases := []struct {
+		url         string
+		contentType string
+		body        string
+		want        bool
+	}{
+		{"/push", "application/x-www-form-urlencoded", "body=hi", false},
+		{"/push", "application/x-www-form-urlencoded", "body=hi&dry_run=1", true},
+		{"/push?dry_run=true", "application/x-www-form-urlencoded", "body=hi", true},
+		{"/push?dry_run=1", "application/json", `{"body":"hi"}`, true},
+		{"/push", "application/json", `{"body":"hi","dry_run":true}`, false},
+		{"/push", "text/plain", "dry_run=1", false},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", c.url, strings.NewReader(c.body))
+		req.Header.Set("Content-Type", c.contentType)
+		if got := dryRunRequest(req, []byte(c.body)); got != c.want {
+			t.Errorf("%s %s %s: dryRunRequest = %v, want %v", c.url, c.contentType, c.body, got, c.want)
+		}
+	}
+}
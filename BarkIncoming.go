@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/boltdb/bolt"
+	"github.com/go-zoo/bone"
+)
+
+// 把第三方服务自己格式的 webhook 转换成推送消息，按路由 /incoming/:source/:target 选择
+type Adapter interface {
+	Name() string
+	// 返回 nil 表示这个事件不需要推送，例如 GitHub 的 ping
+	Translate(r *http.Request, body []byte) (*Message, error)
+}
+
+// 来源支持签名时实现这个接口，设置了密钥的 target 只接受校验通过的请求
+type signedAdapter interface {
+	Verify(r *http.Request, body []byte, secret string) error
+}
+
+var adapters = make(map[string]Adapter)
+
+func registerAdapter(a Adapter) {
+	adapters[a.Name()] = a
+}
+
+const incomingMaxBody = 1 << 20
+
+func incomingSecretKey(source string, target string) []byte {
+	return []byte(source + "/" + target)
+}
+
+func getIncomingSecret(source string, target string) string {
+	var value string
+	boltDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("incoming"))
+		if bucket != nil {
+			value = string(bucket.Get(incomingSecretKey(source, target)))
+		}
+		return nil
+	})
+	return value
+}
+
+func setIncomingSecret(source string, target string, value string) error {
+	return boltDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("incoming"))
+		if err != nil {
+			return err
+		}
+		if len(value) == 0 {
+			return bucket.Delete(incomingSecretKey(source, target))
+		}
+		return bucket.Put(incomingSecretKey(source, target), []byte(value))
+	})
+}
+
+// POST /incoming/:source/:target，target 为 key 或 ntfy 的 topic
+func incoming(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	source := bone.GetValue(r, "source")
+	target := bone.GetValue(r, "target")
+	logger := requestLogger(r).With("source", source, secret("target", redactKey, target))
+
+	adapter := adapters[source]
+	if adapter == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, responseString(404, "不支持的来源 "+source))
+		return
+	}
+	keys := getTopicKeys(target)
+	if len(keys) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, responseString(404, "找不到对应的key或topic"))
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, incomingMaxBody))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, responseString(400, err.Error()))
+		return
+	}
+	if signed, ok := adapter.(signedAdapter); ok {
+		if s := getIncomingSecret(source, target); len(s) > 0 {
+			if err := signed.Verify(r, body, s); err != nil {
+				logger.Warn("签名校验失败", "err", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, responseString(401, err.Error()))
+				return
+			}
+		}
+	}
+
+	msg, err := adapter.Translate(r, body)
+	if err != nil {
+		logger.Info("无法解析webhook", "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, responseString(400, err.Error()))
+		return
+	}
+	if msg == nil {
+		logger.Debug("忽略webhook事件")
+		fmt.Fprint(w, responseString(200, "忽略"))
+		return
+	}
+	if len(msg.Body) == 0 {
+		msg.Body = "无推送文字内容"
+	}
+
+	logger.Debug("收到webhook", secret("title", redactBody, msg.Title), secret("body", redactBody, msg.Body))
+	if err := pushToKeys(r.Context(), keys, clientIP(r), msg); err != nil {
+		if e, ok := err.(*limitError); ok {
+			writeLimited(w, e)
+			return
+		}
+		logger.Warn("推送失败", "err", err)
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, responseString(502, err.Error()))
+		return
+	}
+	logger.Info("推送成功")
+	fmt.Fprint(w, responseString(200, ""))
+}
+
+// POST /incoming/:source/:target/secret 设置签名密钥，DELETE 删除。
+// 知道 URL 的人都能推送，所以已经设置过密钥时，修改和删除都要提供当前的密钥(current)或管理员token；
+// target 是 topic 时，不是管理员还要提供 topic 所有者的 key(owner)
+func incomingSecret(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	source := bone.GetValue(r, "source")
+	target := bone.GetValue(r, "target")
+
+	adapter := adapters[source]
+	if adapter == nil {
+		fmt.Fprint(w, responseString(400, "不支持的来源 "+source))
+		return
+	}
+	if _, ok := adapter.(signedAdapter); !ok {
+		fmt.Fprint(w, responseString(400, source+" 不支持签名校验"))
+		return
+	}
+	if len(getTopicKeys(target)) == 0 {
+		fmt.Fprint(w, responseString(400, "找不到对应的key或topic"))
+		return
+	}
+
+	r.ParseForm()
+	// target 是多个 key 共用的 topic 时，只有 topic 的所有者(owner)或管理员可以设置密钥
+	if !keyExists(target) && !checkAdminToken(r) &&
+		subtle.ConstantTimeCompare([]byte(r.FormValue("owner")), []byte(topicOwner(target, getTopicKeys(target), false))) != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, responseString(403, "设置 topic 的密钥需要提供 topic 所有者的key(owner)或管理员token"))
+		return
+	}
+	current := getIncomingSecret(source, target)
+	if len(current) > 0 && !checkAdminToken(r) &&
+		subtle.ConstantTimeCompare([]byte(r.FormValue("current")), []byte(current)) != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, responseString(403, "已经设置过密钥，修改需要提供当前的密钥"))
+		return
+	}
+
+	value := r.FormValue("secret")
+	if r.Method == "DELETE" {
+		value = ""
+	} else if len(value) == 0 {
+		value = newRequestID() + newRequestID()
+	}
+	if err := setIncomingSecret(source, target, value); err != nil {
+		fmt.Fprint(w, responseString(500, err.Error()))
+		return
+	}
+	if len(value) == 0 {
+		fmt.Fprint(w, responseString(200, "删除成功"))
+		return
+	}
+	fmt.Fprint(w, responseData(200, map[string]interface{}{"secret": value}, "设置成功"))
+}
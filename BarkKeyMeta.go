@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/go-zoo/bone"
+)
+
+// key 的附加信息，以 JSON 形式存放在 meta bucket 中
+type KeyMeta struct {
+	Key          string        `json:"key"`
+	DailyQuota   int           `json:"daily_quota"` // 0 使用 -daily-quota 的默认值，负数不限制；放宽需要管理员token
+	Day          string        `json:"day"`
+	DayCount     int           `json:"day_count"`
+	TotalCount   int64         `json:"total_count"`
+	LimitedCount int64         `json:"limited_count"`
+	LastPushAt   time.Time     `json:"last_push_at"`
+	Quiet        *QuietHours   `json:"quiet,omitempty"`
+	Digest       *DigestConfig `json:"digest,omitempty"`
+	DedupWindow  int           `json:"dedup_window"` // 秒，0 不去重
+	Rules        []routeRule   `json:"rules,omitempty"`
+}
+
+func getKeyMeta(key string) (*KeyMeta, error) {
+	meta := &KeyMeta{Key: key}
+	err := boltDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("meta"))
+		if bucket == nil {
+			return nil
+		}
+		val := bucket.Get([]byte(key))
+		if val == nil {
+			return nil
+		}
+		return json.Unmarshal(val, meta)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// 在同一个事务里读取、修改并写回 key 的附加信息，fn 返回错误时不写入
+func updateKeyMeta(key string, fn func(meta *KeyMeta) error) (*KeyMeta, error) {
+	meta := &KeyMeta{Key: key}
+	err := boltDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("meta"))
+		if err != nil {
+			return err
+		}
+		if val := bucket.Get([]byte(key)); val != nil {
+			if err := json.Unmarshal(val, meta); err != nil {
+				return err
+			}
+		}
+		if err := fn(meta); err != nil {
+			return err
+		}
+		val, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), val)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func keyMeta(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	key := bone.GetValue(r, "key")
+	if !keyExists(key) {
+		fmt.Fprint(w, responseString(400, "找不到key对应的DeviceToken, 请确保Key正确! Key可在App端注册获得。"))
+		return
+	}
+
+	r.ParseForm()
+	quota, window := r.FormValue("daily_quota"), r.FormValue("dedup_window")
+	var meta *KeyMeta
+	var err error
+	if len(quota) > 0 || len(window) > 0 {
+		num, seconds := 0, 0
+		if len(quota) > 0 {
+			if num, err = strconv.Atoi(quota); err != nil {
+				fmt.Fprint(w, responseString(400, "daily_quota 必须是整数"))
+				return
+			}
+			// 持有 key 只能恢复默认值或者把配额调得比默认值更严，放宽或者不限制需要管理员token
+			if !checkAdminToken(r) && (num < 0 || (DailyQuota > 0 && num > DailyQuota)) {
+				message := "daily_quota 不能为负数，取消配额需要管理员token"
+				if DailyQuota > 0 {
+					message = "daily_quota 只能设置为不超过默认值 " + strconv.Itoa(DailyQuota) + " 的非负数，放宽配额需要管理员token"
+				}
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, responseString(403, message))
+				return
+			}
+		}
+		// 秒数或者时长，例如 60、10m，0 关闭去重
+		if len(window) > 0 {
+			if seconds, err = strconv.Atoi(window); err != nil {
+				d, e := time.ParseDuration(window)
+				if e != nil || d < 0 {
+					fmt.Fprint(w, responseString(400, "dedup_window 应为秒数或者时长，例如 60、10m"))
+					return
+				}
+				seconds = int(d / time.Second)
+			}
+			if seconds < 0 || seconds > 86400 {
+				fmt.Fprint(w, responseString(400, "dedup_window 不能超过一天"))
+				return
+			}
+		}
+		meta, err = updateKeyMeta(key, func(meta *KeyMeta) error {
+			if len(quota) > 0 {
+				meta.DailyQuota = num
+			}
+			if len(window) > 0 {
+				meta.DedupWindow = seconds
+			}
+			return nil
+		})
+	} else {
+		meta, err = getKeyMeta(key)
+	}
+	if err != nil {
+		fmt.Fprint(w, responseString(500, err.Error()))
+		return
+	}
+	fmt.Fprint(w, responseData(200, meta, ""))
+}
+
+// 在 bucketName 下以 key 为子 bucket 按顺序追加一条记录，超过 limit 条时删除最早的
+func appendRecord(bucketName string, key string, record interface{}, limit int) (uint64, error) {
+	val, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+	var seq uint64
+	err = boltDB.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+		if err != nil {
+			return err
+		}
+		bucket, err := root.CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return err
+		}
+		seq, err = bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(seqKey(seq), val); err != nil {
+			return err
+		}
+		// 序号是连续的，只保留最新的 limit 条
+		if limit > 0 && seq > uint64(limit) {
+			var expired [][]byte
+			c := bucket.Cursor()
+			for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= seq-uint64(limit); k, _ = c.Next() {
+				expired = append(expired, k)
+			}
+			for _, k := range expired {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return seq, err
+}
+
+// 按顺序读取 key 下序号大于 after 的记录，limit 为 0 时不限制条数，返回最新的 limit 条
+func listRecords(bucketName string, key string, after uint64, limit int, fn func(seq uint64, val []byte) error) error {
+	return boltDB.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(bucketName))
+		if root == nil {
+			return nil
+		}
+		bucket := root.Bucket([]byte(key))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		start := after + 1
+		if limit > 0 {
+			// 从末尾往前数 limit 条
+			n := 0
+			for k, _ := c.Last(); k != nil && n < limit && binary.BigEndian.Uint64(k) > after; k, _ = c.Prev() {
+				start = binary.BigEndian.Uint64(k)
+				n++
+			}
+		}
+		for k, v := c.Seek(seqKey(start)); k != nil; k, v = c.Next() {
+			if err := fn(binary.BigEndian.Uint64(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// 删除 key 下序号不大于 upTo 的记录，全部删完时连同子 bucket 一起删除
+func deleteRecords(bucketName string, key string, upTo uint64) error {
+	return boltDB.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(bucketName))
+		if root == nil {
+			return nil
+		}
+		bucket := root.Bucket([]byte(key))
+		if bucket == nil {
+			return nil
+		}
+		var expired [][]byte
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= upTo; k, _ = c.Next() {
+			expired = append(expired, k)
+		}
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		if k, _ := bucket.Cursor().First(); k == nil {
+			return root.DeleteBucket([]byte(key))
+		}
+		return nil
+	})
+}
+
+// bucketName 下有记录的 key 及其记录数
+func recordCounts(bucketName string) map[string]int {
+	counts := make(map[string]int)
+	boltDB.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(bucketName))
+		if root == nil {
+			return nil
+		}
+		return root.ForEach(func(k, v []byte) error {
+			if bucket := root.Bucket(k); bucket != nil {
+				if n := bucket.Stats().KeyN; n > 0 {
+					counts[string(k)] = n
+				}
+			}
+			return nil
+		})
+	})
+	return counts
+}
+
+func seqKey(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// 证书文件在 SIGHUP 时重新加载，新连接使用新证书，已建立的连接不受影响
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func newCertReloader(certFile string, keyFile string, caFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if len(c.caFile) > 0 {
+		pem, err := ioutil.ReadFile(c.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("客户端CA文件中没有可用的证书 " + c.caFile)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.clientCAs = pool
+	return nil
+}
+
+// clientAuth 只在配置了客户端CA时生效
+func (c *certReloader) tlsConfig(clientAuth tls.ClientAuthType) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*c.cert},
+				NextProtos:   []string{"h2", "http/1.1"},
+			}
+			if c.clientCAs != nil {
+				config.ClientCAs = c.clientCAs
+				config.ClientAuth = clientAuth
+			}
+			return config, nil
+		},
+	}
+}
+
+func parseClientAuth(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	}
+	return tls.NoClientCert, errors.New("未知的客户端认证方式 " + mode)
+}
+
+// 按配置创建监听：systemd 传入的 fd、Unix socket，或者 TCP 地址
+func listen(addr string, unixSocket string, socketMode os.FileMode, systemd bool) ([]net.Listener, error) {
+	if systemd {
+		return systemdListeners()
+	}
+	if len(unixSocket) > 0 {
+		// 上次异常退出可能残留 socket 文件
+		if info, err := os.Stat(unixSocket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(unixSocket)
+		}
+		l, err := net.Listen("unix", unixSocket)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(unixSocket, socketMode); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{l}, nil
+}
+
+// systemd socket activation，fd 从 3 开始，数量由 LISTEN_FDS 指定
+func systemdListeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, errors.New("LISTEN_PID 与当前进程不符，请确认由 systemd socket 启动")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, errors.New("没有从 systemd 收到监听的 fd")
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	for fd := 3; fd < 3+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		slog.Info("使用 systemd 传入的监听", "fd", fd, "addr", l.Addr().String())
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
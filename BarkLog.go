@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// 日志中需要脱敏的字段类型
+const (
+	redactKey   = "key"
+	redactToken = "token"
+	redactBody  = "body"
+)
+
+var redactFields = map[string]bool{}
+var redactMode = "hash"
+var AccessLog bool = false
+
+// format: text(logfmt) 或 json; fields: 逗号分隔的 key,token,body; mode: hash, truncate 或 none
+func setupLogger(format string, level string, fields string, mode string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return errors.New("未知的日志级别 " + level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch format {
+	case "text", "logfmt":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return errors.New("未知的日志格式 " + format)
+	}
+	slog.SetDefault(slog.New(handler))
+
+	switch mode {
+	case "hash", "truncate", "none":
+		redactMode = mode
+	default:
+		return errors.New("未知的脱敏方式 " + mode)
+	}
+	redactFields = map[string]bool{}
+	for _, field := range strings.Split(fields, ",") {
+		if field = strings.TrimSpace(field); len(field) > 0 {
+			redactFields[field] = true
+		}
+	}
+	return nil
+}
+
+// 按配置对敏感内容做脱敏，hash 保留可比对的短摘要，truncate 只保留开头几个字符
+func redact(kind string, value string) string {
+	if !redactFields[kind] || len(value) == 0 {
+		return value
+	}
+	switch redactMode {
+	case "hash":
+		return hashSecret(value)
+	case "truncate":
+		if utf8.RuneCountInString(value) <= 4 {
+			return strings.Repeat("*", utf8.RuneCountInString(value))
+		}
+		return string([]rune(value)[:4]) + "…"
+	}
+	return value
+}
+
+// 可比对的短摘要，与日志中 hash 方式脱敏的结果一致
+func hashSecret(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
+
+func secret(name string, kind string, value string) slog.Attr {
+	return slog.String(name, redact(kind, value))
+}
+
+type requestIDKey struct{}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// 沿用调用方传入的 X-Request-ID，没有则生成一个，并写回响应头
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get("X-Request-ID")
+	if len(id) == 0 || len(id) > 64 {
+		id = newRequestID()
+	}
+	w.Header().Set("X-Request-ID", id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+func requestLogger(r *http.Request) *slog.Logger {
+	if id, ok := r.Context().Value(requestIDKey{}).(string); ok {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+func accessLog(r *http.Request, route string, code int, start time.Time) {
+	if !AccessLog {
+		return
+	}
+	requestLogger(r).Info("access",
+		"method", r.Method,
+		"route", route,
+		"status", code,
+		"duration", time.Since(start),
+		"ip", clientIP(r),
+		"user_agent", r.UserAgent(),
+	)
+}
+
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
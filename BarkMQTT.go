@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTT 桥接：订阅 Topic（例如 bark/+/push，+ 所在的一级是 key 或 ntfy topic），
+// 收到的消息转成推送，结果发布到 ResultTopic（{key} 替换为 key），ResultTopic 为空时不发布
+type mqttConfig struct {
+	Broker      string
+	ClientID    string
+	Username    string
+	Password    string
+	Topic       string
+	ResultTopic string
+	QoS         byte
+}
+
+// 发布到 ResultTopic 的推送结果，request_id 是收到的消息中的 request_id，方便对应请求。
+// 带 dry_run 的消息不推送，preview 为每个 key 将要发出的请求
+type mqttResult struct {
+	RequestID string                   `json:"request_id,omitempty"`
+	Key       string                   `json:"key"`
+	Code      int                      `json:"code"`
+	Message   string                   `json:"message"`
+	Preview   map[string][]pushPreview `json:"preview,omitempty"`
+	Time      int64                    `json:"time"`
+}
+
+// MQTT 推送共用一个来源 IP 的限流
+const mqttClientIP = "mqtt"
+
+// Topic 中必须有且只有一级是 +，不支持 #
+func (c *mqttConfig) keyLevel() (int, error) {
+	index := -1
+	for i, level := range strings.Split(c.Topic, "/") {
+		switch {
+		case level == "+" && index >= 0:
+			return 0, errors.New("mqtt topic 中只能有一个 +")
+		case level == "+":
+			index = i
+		case strings.ContainsAny(level, "+#"):
+			return 0, errors.New("mqtt topic 中只能用 + 代表 key，不支持 #")
+		}
+	}
+	if index < 0 {
+		return 0, errors.New("mqtt topic 中需要用 + 代表 key，例如 bark/+/push")
+	}
+	return index, nil
+}
+
+func (c *mqttConfig) validate() error {
+	index, err := c.keyLevel()
+	if err != nil {
+		return err
+	}
+	if c.QoS > 2 {
+		return errors.New("mqtt qos 只能是 0、1 或 2")
+	}
+	// 结果不能再被自己订阅到
+	if len(c.ResultTopic) > 0 {
+		result := strings.Split(strings.ReplaceAll(c.ResultTopic, "{key}", "key"), "/")
+		topic := strings.Split(c.Topic, "/")
+		if len(result) == len(topic) {
+			same := true
+			for i := range topic {
+				if i != index && topic[i] != result[i] {
+					same = false
+				}
+			}
+			if same {
+				return errors.New("mqtt 结果的 topic 不能与订阅的 topic 匹配")
+			}
+		}
+	}
+	return nil
+}
+
+// 消息内容可以是与 /push 相同的 JSON（不需要 device_key），也可以是纯文本，整个作为推送内容。
+// 返回推送、request_id 以及是否只预览
+func mqttMessage(payload []byte) (*Message, string, bool) {
+	req := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return &Message{Body: string(payload), Params: map[string]interface{}{}}, "", false
+	}
+	requestID, _ := req["request_id"].(string)
+	delete(req, "request_id")
+	dryRun := req["dry_run"] == true || req["dry_run"] == "1" || req["dry_run"] == "true"
+	return jsonMessage(req), requestID, dryRun
+}
+
+func (c *mqttConfig) handle(client mqtt.Client, m mqtt.Message) {
+	index, _ := c.keyLevel()
+	levels := strings.Split(m.Topic(), "/")
+	if index >= len(levels) {
+		return
+	}
+	target := levels[index]
+	logger := slog.Default().With(secret("key", redactKey, target), "message_id", m.MessageID())
+
+	msg, requestID, dryRun := mqttMessage(m.Payload())
+	result := &mqttResult{RequestID: requestID, Key: target, Code: 200, Time: time.Now().Unix()}
+	keys := getTopicKeys(target)
+	if len(keys) == 0 {
+		result.Code = 400
+		result.Message = "找不到key对应的DeviceToken, 请确保Key正确! Key可在App端注册获得。"
+	} else if dryRun {
+		// 预览只能通过 ResultTopic 返回，没有设置时也不会推送
+		result.Message = "预览，未发送"
+		result.Preview = map[string][]pushPreview{}
+		for _, key := range keys {
+			list, err := previewPush(key, msg)
+			if err != nil {
+				result.Code = 500
+				result.Message = err.Error()
+				result.Preview = nil
+				break
+			}
+			result.Preview[key] = list
+		}
+	} else {
+		logger.Debug("收到MQTT推送", secret("title", redactBody, msg.Title), secret("body", redactBody, msg.Body))
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := pushToKeys(ctx, keys, mqttClientIP, msg)
+		cancel()
+		var limited *limitError
+		switch {
+		case errors.As(err, &limited):
+			result.Code = 429
+			result.Message = limited.Message
+		case err != nil:
+			result.Code = 400
+			result.Message = err.Error()
+		}
+	}
+	if result.Code == 200 && dryRun {
+		logger.Info("MQTT推送预览", "keys", len(keys))
+	} else if result.Code == 200 {
+		logger.Info("MQTT推送成功", "keys", len(keys))
+	} else {
+		logger.Warn("MQTT推送失败", "code", result.Code, "err", result.Message)
+	}
+
+	if len(c.ResultTopic) == 0 {
+		return
+	}
+	data, _ := json.Marshal(result)
+	token := client.Publish(strings.ReplaceAll(c.ResultTopic, "{key}", target), c.QoS, false, data)
+	if !token.WaitTimeout(10*time.Second) || token.Error() != nil {
+		logger.Warn("发布MQTT推送结果失败", "err", token.Error())
+	}
+}
+
+// 连接断开后自动重连，每次连上后都重新订阅
+func newMQTTClient(c mqttConfig) (mqtt.Client, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	logger := slog.Default().With("broker", c.Broker)
+	opts := mqtt.NewClientOptions().
+		AddBroker(c.Broker).
+		SetClientID(c.ClientID).
+		SetUsername(c.Username).
+		SetPassword(c.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(10 * time.Second).
+		SetOrderMatters(false)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		token := client.Subscribe(c.Topic, c.QoS, c.handle)
+		if !token.WaitTimeout(10*time.Second) || token.Error() != nil {
+			logger.Error("订阅MQTT topic失败", "topic", c.Topic, "err", token.Error())
+			return
+		}
+		logger.Info("已连接MQTT服务器", "topic", c.Topic)
+	})
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		logger.Warn("与MQTT服务器的连接断开", "err", err)
+	})
+
+	return mqtt.NewClient(opts), nil
+}
+
+func startMQTT(c mqttConfig) error {
+	client, err := newMQTTClient(c)
+	if err != nil {
+		return err
+	}
+	client.Connect()
+	onShutdown(func(ctx context.Context) {
+		client.Disconnect(250)
+	})
+	return nil
+}
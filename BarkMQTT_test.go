@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func openTestDB(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "bark.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"device", "meta"} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := boltDB
+	boltDB = db
+	t.Cleanup(func() {
+		boltDB = old
+		db.Close()
+	})
+}
+
+type fakeMQTTToken struct{}
+
+func (fakeMQTTToken) Wait() bool                     { return true }
+func (fakeMQTTToken) WaitTimeout(time.Duration) bool { return true }
+func (fakeMQTTToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+func (fakeMQTTToken) Error() error { return nil }
+
+type mqttPublished struct {
+	topic   string
+	qos     byte
+	payload []byte
+}
+
+// 只实现 Publish，记录发布的推送结果
+type fakeMQTTClient struct {
+	mqtt.Client
+	mu        sync.Mutex
+	published []mqttPublished
+}
+
+func (c *fakeMQTTClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.published = append(c.published, mqttPublished{topic: topic, qos: qos, payload: payload.([]byte)})
+	return fakeMQTTToken{}
+}
+
+type fakeMQTTMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *fakeMQTTMessage) Duplicate() bool   { return false }
+func (m *fakeMQTTMessage) Qos() byte         { return 1 }
+func (m *fakeMQTTMessage) Retained() bool    { return false }
+func (m *fakeMQTTMessage) Topic() string     { return m.topic }
+func (m *fakeMQTTMessage) MessageID() uint16 { return 1 }
+func (m *fakeMQTTMessage) Payload() []byte   { return m.payload }
+func (m *fakeMQTTMessage) Ack()              {}
+
+func TestMQTTTopic(t *testing.T) {
+	cases := []struct {
+		topic   string
+		result  string
+		qos     byte
+		level   int
+		wantErr bool
+	}{
+		{topic: "bark/+/push", result: "bark/{key}/result", level: 1},
+		{topic: "+", level: 0},
+		{topic: "home/alerts/+", result: "", qos: 2, level: 2},
+		{topic: "bark/push", wantErr: true},
+		{topic: "bark/+/+", wantErr: true},
+		{topic: "bark/#", wantErr: true},
+		{topic: "bark/+/push#", wantErr: true},
+		{topic: "bark/+/push", qos: 3, wantErr: true},
+		{topic: "bark/+/push", result: "bark/{key}/push", wantErr: true},
+		{topic: "bark/+/push", result: "bark/result/push", wantErr: true},
+	}
+	for _, c := range cases {
+		config := &mqttConfig{Topic: c.topic, ResultTopic: c.result, QoS: c.qos}
+		err := config.validate()
+		if (err != nil) != c.wantErr {
+			t.Errorf("validate(%q, %q) = %v, want error %v", c.topic, c.result, err, c.wantErr)
+			continue
+		}
+		if c.wantErr {
+			continue
+		}
+		if level, _ := config.keyLevel(); level != c.level {
+			t.Errorf("keyLevel(%q) = %d, want %d", c.topic, level, c.level)
+		}
+	}
+}
+
+func TestMQTTMessage(t *testing.T) {
+	msg, requestID, dryRun := mqttMessage([]byte(`{"request_id":"r1","title":"UPS","body":"断电","sound":"alarm","device_key":"x"}`))
+	if requestID != "r1" || dryRun || msg.Title != "UPS" || msg.Body != "断电" || msg.Params["sound"] != "alarm" {
+		t.Errorf("json message = %+v, request_id = %q, dry_run = %v", msg, requestID, dryRun)
+	}
+	if _, ok := msg.Params["request_id"]; ok {
+		t.Error("request_id should not be a push parameter")
+	}
+	if _, ok := msg.Params["device_key"]; ok {
+		t.Error("device_key should not be a push parameter")
+	}
+
+	msg, requestID, dryRun = mqttMessage([]byte("门口有人"))
+	if requestID != "" || dryRun || msg.Body != "门口有人" || len(msg.Params) != 0 {
+		t.Errorf("text message = %+v, request_id = %q, dry_run = %v", msg, requestID, dryRun)
+	}
+
+	msg, _, _ = mqttMessage([]byte(`{"title":"只有标题"}`))
+	if msg.Body != "无推送文字内容" {
+		t.Errorf("empty body = %q", msg.Body)
+	}
+
+	for _, payload := range []string{`{"body":"hi","dry_run":true}`, `{"body":"hi","dry_run":"1"}`} {
+		msg, _, dryRun = mqttMessage([]byte(payload))
+		if !dryRun {
+			t.Errorf("%s: dry_run = false", payload)
+		}
+		if _, ok := msg.Params["dry_run"]; ok {
+			t.Errorf("%s: dry_run should not be a push parameter", payload)
+		}
+	}
+}
+
+func TestMQTTHandle(t *testing.T) {
+	openTestDB(t)
+	allowPrivateWebhooks(t, true)
+	registerProvider(newWebhookProvider())
+
+	received := make(chan *Message, 1)
+	srv := fakeProviderServer(t, http.StatusOK, "", func(r *http.Request) {
+		msg := &Message{}
+		json.NewDecoder(r.Body).Decode(msg)
+		received <- msg
+	})
+	key := "mqttTestKey001"
+	if err := saveDevice(key, Device{Provider: "webhook", Token: srv.URL}); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &mqttConfig{Topic: "bark/+/push", ResultTopic: "bark/{key}/result", QoS: 1}
+	client := &fakeMQTTClient{}
+	config.handle(client, &fakeMQTTMessage{topic: "bark/" + key + "/push", payload: []byte(`{"request_id":"r1","title":"门铃","body":"有人按门铃"}`)})
+	select {
+	case msg := <-received:
+		if msg.Title != "门铃" || msg.Body != "有人按门铃" {
+			t.Errorf("pushed message = %+v", msg)
+		}
+	default:
+		t.Fatal("message was not pushed")
+	}
+
+	config.handle(client, &fakeMQTTMessage{topic: "bark/unknownKey01/push", payload: []byte("hi")})
+	// 层数不够的 topic 直接忽略
+	config.handle(client, &fakeMQTTMessage{topic: "bark", payload: []byte("hi")})
+
+	if len(client.published) != 2 {
+		t.Fatalf("published %d results, want 2", len(client.published))
+	}
+	want := []struct {
+		topic     string
+		key       string
+		code      int
+		requestID string
+	}{
+		{"bark/" + key + "/result", key, 200, "r1"},
+		{"bark/unknownKey01/result", "unknownKey01", 400, ""},
+	}
+	for i, w := range want {
+		p := client.published[i]
+		result := &mqttResult{}
+		if err := json.Unmarshal(p.payload, result); err != nil {
+			t.Fatal(err)
+		}
+		if p.topic != w.topic || p.qos != 1 || result.Key != w.key || result.Code != w.code || result.RequestID != w.requestID {
+			t.Errorf("result %d = %s %s, want topic %s code %d", i, p.topic, p.payload, w.topic, w.code)
+		}
+	}
+
+	// dry_run 不推送，把预览作为结果发布
+	config.handle(client, &fakeMQTTMessage{topic: "bark/" + key + "/push", payload: []byte(`{"request_id":"r2","body":"测试","dry_run":true}`)})
+	select {
+	case msg := <-received:
+		t.Fatalf("dry_run message was pushed: %+v", msg)
+	default:
+	}
+	if len(client.published) != 3 {
+		t.Fatalf("published %d results, want 3", len(client.published))
+	}
+	result := &mqttResult{}
+	if err := json.Unmarshal(client.published[2].payload, result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Code != 200 || result.RequestID != "r2" || len(result.Preview[key]) != 1 || result.Preview[key][0].Provider != "webhook" {
+		t.Errorf("dry_run result = %s", client.published[2].payload)
+	}
+
+	// ResultTopic 为空时不发布结果
+	config.ResultTopic = ""
+	config.handle(client, &fakeMQTTMessage{topic: "bark/" + key + "/push", payload: []byte("again")})
+	<-received
+	if len(client.published) != 3 {
+		t.Errorf("published %d results, want 3", len(client.published))
+	}
+}
+
+// 测试用的 MQTT 3.1.1 broker，只实现 bark 用到的部分：连接、订阅（支持 + 和 #）、QoS 0/1/2 的发布和心跳。
+// 客户端发布的消息都记录到 published，kick 断开所有连接，模拟 broker 重启
+type testBroker struct {
+	t          *testing.T
+	ln         net.Listener
+	published  chan mqttPublished
+	subscribed chan testSubscription
+
+	mu     sync.Mutex
+	conns  map[*brokerConn]bool
+	subs   []testSubscription
+	nextID uint16
+}
+
+type testSubscription struct {
+	conn   *brokerConn
+	filter string
+	qos    byte
+}
+
+type brokerConn struct {
+	net.Conn
+	mu sync.Mutex
+}
+
+func (c *brokerConn) send(header byte, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	packet := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 128
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	c.Write(append(packet, body...))
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{
+		t:          t,
+		ln:         ln,
+		published:  make(chan mqttPublished, 16),
+		subscribed: make(chan testSubscription, 16),
+		conns:      map[*brokerConn]bool{},
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c := &brokerConn{Conn: conn}
+			b.mu.Lock()
+			b.conns[c] = true
+			b.mu.Unlock()
+			go b.serve(c)
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		b.kick()
+	})
+	return b
+}
+
+func (b *testBroker) url() string {
+	return "tcp://" + b.ln.Addr().String()
+}
+
+func (b *testBroker) kick() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		c.Close()
+	}
+	b.subs = nil
+}
+
+func topicMatches(filter string, topic string) bool {
+	f := strings.Split(filter, "/")
+	l := strings.Split(topic, "/")
+	for i := range f {
+		if f[i] == "#" {
+			return true
+		}
+		if i >= len(l) || (f[i] != "+" && f[i] != l[i]) {
+			return false
+		}
+	}
+	return len(f) == len(l)
+}
+
+// 发给订阅了 topic 的客户端，QoS 取发布和订阅中较小的
+func (b *testBroker) publish(topic string, payload []byte, qos byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, sub := range b.subs {
+		if !topicMatches(sub.filter, topic) {
+			continue
+		}
+		q := qos
+		if sub.qos < q {
+			q = sub.qos
+		}
+		body := binary.BigEndian.AppendUint16(nil, uint16(len(topic)))
+		body = append(body, topic...)
+		if q > 0 {
+			b.nextID++
+			if b.nextID == 0 {
+				b.nextID = 1
+			}
+			body = binary.BigEndian.AppendUint16(body, b.nextID)
+		}
+		sub.conn.send(0x30|q<<1, append(body, payload...))
+	}
+}
+
+func (b *testBroker) serve(c *brokerConn) {
+	defer func() {
+		c.Close()
+		b.mu.Lock()
+		delete(b.conns, c)
+		b.mu.Unlock()
+	}()
+	r := bufio.NewReader(c)
+	for {
+		header, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		length, multiplier := 0, 1
+		for {
+			d, err := r.ReadByte()
+			if err != nil {
+				return
+			}
+			length += int(d&127) * multiplier
+			multiplier *= 128
+			if d&128 == 0 {
+				break
+			}
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case 1: // CONNECT
+			c.send(0x20, []byte{0, 0})
+		case 3: // PUBLISH
+			qos := header >> 1 & 3
+			n := int(binary.BigEndian.Uint16(body))
+			p := mqttPublished{topic: string(body[2 : 2+n]), qos: qos}
+			rest := body[2+n:]
+			if qos > 0 {
+				id := rest[:2]
+				rest = rest[2:]
+				if qos == 1 {
+					c.send(0x40, id)
+				} else {
+					c.send(0x50, id)
+				}
+			}
+			p.payload = append([]byte{}, rest...)
+			b.published <- p
+			go b.publish(p.topic, p.payload, qos)
+		case 5: // PUBREC，回复 PUBREL
+			c.send(0x62, body[:2])
+		case 6: // PUBREL，回复 PUBCOMP
+			c.send(0x70, body[:2])
+		case 8: // SUBSCRIBE
+			granted := append([]byte{}, body[:2]...)
+			for rest := body[2:]; len(rest) > 2; {
+				n := int(binary.BigEndian.Uint16(rest))
+				sub := testSubscription{conn: c, filter: string(rest[2 : 2+n]), qos: rest[2+n]}
+				rest = rest[3+n:]
+				b.mu.Lock()
+				b.subs = append(b.subs, sub)
+				b.mu.Unlock()
+				granted = append(granted, sub.qos)
+				b.subscribed <- sub
+			}
+			c.send(0x90, granted)
+		case 10: // UNSUBSCRIBE
+			c.send(0xb0, body[:2])
+		case 12: // PINGREQ
+			c.send(0xd0, nil)
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+func (b *testBroker) waitSubscribe() testSubscription {
+	b.t.Helper()
+	select {
+	case sub := <-b.subscribed:
+		return sub
+	case <-time.After(10 * time.Second):
+		b.t.Fatal("client did not subscribe")
+	}
+	return testSubscription{}
+}
+
+// 返回 bark 发布的 request_id 对应的推送结果。跳过测试自己发布的消息，
+// 以及断线时还没有确认、重连后重发的之前的结果
+func (b *testBroker) waitResult(topic string, requestID string) (mqttPublished, *mqttResult) {
+	b.t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case p := <-b.published:
+			if p.topic != topic {
+				continue
+			}
+			result := &mqttResult{}
+			if err := json.Unmarshal(p.payload, result); err != nil {
+				b.t.Fatalf("result %s: %v", p.payload, err)
+			}
+			if result.RequestID != requestID {
+				continue
+			}
+			return p, result
+		case <-timeout:
+			b.t.Fatalf("no result published to %s", topic)
+		}
+	}
+}
+
+// 通过真实的 MQTT 连接：连上后订阅、断线重连后重新订阅，收到消息后推送并发布结果
+func TestMQTTBroker(t *testing.T) {
+	openTestDB(t)
+	allowPrivateWebhooks(t, true)
+	registerProvider(newWebhookProvider())
+
+	received := make(chan *Message, 4)
+	srv := fakeProviderServer(t, http.StatusOK, "", func(r *http.Request) {
+		msg := &Message{}
+		json.NewDecoder(r.Body).Decode(msg)
+		received <- msg
+	})
+	key := "mqttBrokerKey1"
+	if err := saveDevice(key, Device{Provider: "webhook", Token: srv.URL}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, qos := range []byte{0, 1, 2} {
+		broker := newTestBroker(t)
+		config := mqttConfig{
+			Broker:      broker.url(),
+			ClientID:    "bark-test-" + strconv.Itoa(int(qos)),
+			Topic:       "bark/+/push",
+			ResultTopic: "bark/{key}/result",
+			QoS:         qos,
+		}
+		client, err := newMQTTClient(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Connect()
+
+		for round, event := range []string{"connect", "reconnect"} {
+			sub := broker.waitSubscribe()
+			if sub.filter != config.Topic || sub.qos != qos {
+				t.Fatalf("qos %d %s: subscribed %s qos %d", qos, event, sub.filter, sub.qos)
+			}
+			requestID := event + "-" + strconv.Itoa(int(qos))
+			broker.publish("bark/"+key+"/push", []byte(`{"request_id":"`+requestID+`","title":"门铃","body":"有人按门铃"}`), 2)
+			select {
+			case msg := <-received:
+				if msg.Title != "门铃" || msg.Body != "有人按门铃" {
+					t.Errorf("qos %d %s: pushed %+v", qos, event, msg)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("qos %d %s: message was not pushed", qos, event)
+			}
+			p, result := broker.waitResult("bark/"+key+"/result", requestID)
+			if p.qos != qos || result.Code != 200 || result.Key != key {
+				t.Errorf("qos %d %s: result qos %d %s", qos, event, p.qos, p.payload)
+			}
+			if round == 0 {
+				broker.kick()
+			}
+		}
+		client.Disconnect(250)
+	}
+}
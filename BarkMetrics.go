@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bark_http_requests_total",
+		Help: "HTTP requests by route, HTTP status code and result (the code field of the JSON response, or the HTTP status when there is none).",
+	}, []string{"route", "code", "result"})
+
+	pushResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bark_push_total",
+		Help: "Push attempts by provider and reason (APNs reason for apns), Success for delivered pushes.",
+	}, []string{"provider", "reason"})
+
+	pushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bark_push_duration_seconds",
+		Help:    "Latency of requests to the push provider (APNs, FCM, ...).",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"provider"})
+
+	registeredDevices = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "bark_registered_devices",
+		Help: "Number of registered keys.",
+	}, func() float64 {
+		var n int
+		boltDB.View(func(tx *bolt.Tx) error {
+			if bucket := tx.Bucket([]byte("device")); bucket != nil {
+				n = bucket.Stats().KeyN
+			}
+			return nil
+		})
+		return float64(n)
+	})
+
+	dbSize = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "bark_db_size_bytes",
+		Help: "Size of the bolt database.",
+	}, func() float64 {
+		var size int64
+		boltDB.View(func(tx *bolt.Tx) error {
+			size = tx.Size()
+			return nil
+		})
+		return float64(size)
+	})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, pushResults, pushDuration, registeredDevices, dbSize, queues)
+}
+
+// 各个等待队列的长度，由使用队列的模块通过 registerQueue 注册
+type queueCollector struct {
+	mu   sync.Mutex
+	lens map[string]func() int
+}
+
+var queues = &queueCollector{lens: make(map[string]func() int)}
+
+var queueDepthDesc = prometheus.NewDesc("bark_queue_depth", "Number of items waiting in a queue.", []string{"queue"}, nil)
+
+func registerQueue(name string, length func() int) {
+	queues.mu.Lock()
+	defer queues.mu.Unlock()
+	queues.lens[name] = length
+}
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, length := range c.lens {
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(length()), name)
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	code    int
+	result  int
+	written bool
+}
+
+var resultPrefix = []byte(`{"code":`)
+
+// 错误大多以 HTTP 200 返回，真正的结果在 BaseResponse 的 code 中，从第一次写入的内容中取出
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if !r.written {
+		r.written = true
+		if bytes.HasPrefix(b, resultPrefix) {
+			digits := b[len(resultPrefix):]
+			n := 0
+			for n < len(digits) && digits[n] >= '0' && digits[n] <= '9' {
+				n++
+			}
+			r.result, _ = strconv.Atoi(string(digits[:n]))
+		}
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// 让 http.ResponseController 可以取到底层的 ResponseWriter，用于 SSE 的 Flush 和取消写超时
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// websocket 握手直接断言 http.Hijacker，不会经过 Unwrap
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.code = http.StatusSwitchingProtocols
+	return http.NewResponseController(r.ResponseWriter).Hijack()
+}
+
+// 记录每个路由的请求数和访问日志，route 使用注册时的路由模板，避免 key 等参数进入 label 和日志
+func instrument(route string, h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r = withRequestID(w, r)
+		r = r.WithContext(withClientIP(r.Context(), clientIP(r)))
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h(rec, r)
+		result := rec.result
+		if result == 0 {
+			result = rec.code
+		}
+		httpRequests.WithLabelValues(route, strconv.Itoa(rec.code), strconv.Itoa(result)).Inc()
+		accessLog(r, route, rec.code, start)
+	})
+}
+
+func observePush(provider string, start time.Time, reason string) {
+	pushDuration.WithLabelValues(provider).Observe(time.Since(start).Seconds())
+	pushResults.WithLabelValues(provider, reason).Inc()
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/go-zoo/bone"
+)
+
+// 兼容 ntfy 的发布方式：POST/PUT /:topic 请求体为消息内容，其它字段放在 X-Title 等请求头或参数中；
+// 也支持 POST / 发送 JSON。topic 在 ntfy bucket 中绑定到一个或多个 key，未绑定时 topic 本身可以是 key
+var ntfyTopicPattern = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)
+
+// 与已有路由重名的 topic 不能使用
+var ntfyReserved = map[string]bool{
+	"ping": true, "register": true, "metrics": true, "healthz": true, "readyz": true, "message": true,
+	"admin": true, "webpush": true, "webhook": true, "meta": true, "gotify": true, "ntfy": true,
+	"alertmanager": true, "incoming": true, "template": true, "quiet": true, "digest": true,
+	"rules": true, "push": true,
+}
+
+const ntfyMaxBody = 4096
+const ntfyMaxKeys = 20
+
+type ntfyMessage struct {
+	ID       string   `json:"id"`
+	Time     int64    `json:"time"`
+	Event    string   `json:"event"`
+	Topic    string   `json:"topic"`
+	Message  string   `json:"message"`
+	Title    string   `json:"title,omitempty"`
+	Priority int      `json:"priority,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Click    string   `json:"click,omitempty"`
+	Icon     string   `json:"icon,omitempty"`
+	Attach   string   `json:"attach,omitempty"`
+}
+
+func ntfyError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	data, _ := json.Marshal(map[string]interface{}{"code": code, "http": code, "error": message})
+	fmt.Fprint(w, string(data))
+}
+
+func getTopicKeys(topic string) []string {
+	var keys []string
+	boltDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("ntfy"))
+		if bucket == nil {
+			return nil
+		}
+		if val := bucket.Get([]byte(topic)); val != nil {
+			return json.Unmarshal(val, &keys)
+		}
+		return nil
+	})
+	if len(keys) == 0 && keyExists(topic) {
+		keys = []string{topic}
+	}
+	return keys
+}
+
+// topic 的所有者：第一个绑定的 key，没有绑定时是 topic 本身对应的 key
+func topicOwner(topic string, keys []string, topicIsKey bool) string {
+	if len(keys) > 0 {
+		return keys[0]
+	}
+	if topicIsKey {
+		return topic
+	}
+	return ""
+}
+
+func updateTopicKeys(topic string, fn func(keys []string) []string) error {
+	return boltDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("ntfy"))
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if val := bucket.Get([]byte(topic)); val != nil {
+			if err := json.Unmarshal(val, &keys); err != nil {
+				return err
+			}
+		}
+		keys = fn(keys)
+		if len(keys) == 0 {
+			return bucket.Delete([]byte(topic))
+		}
+		val, err := json.Marshal(keys)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(topic), val)
+	})
+}
+
+// 依次从请求头和 URL 参数中取值，和 ntfy 一样支持多个别名
+func ntfyParam(r *http.Request, names ...string) string {
+	for _, name := range names {
+		if value := r.Header.Get(name); len(value) > 0 {
+			return value
+		}
+	}
+	query := r.URL.Query()
+	for _, name := range names {
+		if value := query.Get(strings.ToLower(name)); len(value) > 0 {
+			return value
+		}
+	}
+	return ""
+}
+
+func parseNtfyPriority(value string) (int, bool) {
+	switch strings.ToLower(value) {
+	case "":
+		return 0, true
+	case "1", "min":
+		return 1, true
+	case "2", "low":
+		return 2, true
+	case "3", "default":
+		return 3, true
+	case "4", "high":
+		return 4, true
+	case "5", "max", "urgent":
+		return 5, true
+	}
+	return 0, false
+}
+
+// ntfy 的优先级对应 APNs 的 interruption-level，topic 作为 thread-id 把同一 topic 的通知归为一组
+func ntfyParams(m *ntfyMessage) map[string]interface{} {
+	params := map[string]interface{}{"group": m.Topic}
+	switch {
+	case m.Priority == 1 || m.Priority == 2:
+		params["level"] = "passive"
+	case m.Priority >= 4:
+		params["level"] = "timeSensitive"
+	case m.Priority == 3:
+		params["level"] = "active"
+	}
+	if len(m.Tags) > 0 {
+		params["tags"] = strings.Join(m.Tags, ",")
+	}
+	if len(m.Click) > 0 {
+		params["url"] = m.Click
+	}
+	if len(m.Icon) > 0 {
+		params["icon"] = m.Icon
+	}
+	if len(m.Attach) > 0 {
+		params["image"] = m.Attach
+	}
+	return params
+}
+
+// POST/PUT /:topic
+func ntfyPublish(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(r.Body, ntfyMaxBody+1))
+	if err != nil {
+		ntfyError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(body) > ntfyMaxBody {
+		ntfyError(w, http.StatusRequestEntityTooLarge, "消息内容不能超过 "+strconv.Itoa(ntfyMaxBody)+" 字节")
+		return
+	}
+	priority, ok := parseNtfyPriority(ntfyParam(r, "X-Priority", "Priority", "Prio", "P"))
+	if !ok {
+		ntfyError(w, http.StatusBadRequest, "priority 只能是 1-5 或 min/low/default/high/max/urgent")
+		return
+	}
+	m := &ntfyMessage{
+		Topic:    bone.GetValue(r, "topic"),
+		Message:  strings.TrimSpace(string(body)),
+		Title:    ntfyParam(r, "X-Title", "Title", "Ti", "T"),
+		Priority: priority,
+		Click:    ntfyParam(r, "X-Click", "Click"),
+		Icon:     ntfyParam(r, "X-Icon", "Icon"),
+		Attach:   ntfyParam(r, "X-Attach", "Attach", "A"),
+	}
+	if message := ntfyParam(r, "X-Message", "Message", "M"); len(message) > 0 {
+		m.Message = message
+	}
+	if tags := ntfyParam(r, "X-Tags", "Tags", "Tag", "Ta"); len(tags) > 0 {
+		for _, tag := range strings.Split(tags, ",") {
+			if tag = strings.TrimSpace(tag); len(tag) > 0 {
+				m.Tags = append(m.Tags, tag)
+			}
+		}
+	}
+	publishNtfy(w, r, m)
+}
+
+// POST / 发送 JSON，格式与 ntfy 相同
+func ntfyPublishJSON(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	m := &ntfyMessage{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, ntfyMaxBody*2)).Decode(m); err != nil {
+		ntfyError(w, http.StatusBadRequest, "JSON 格式不正确")
+		return
+	}
+	if m.Priority < 0 || m.Priority > 5 {
+		ntfyError(w, http.StatusBadRequest, "priority 只能是 1-5")
+		return
+	}
+	publishNtfy(w, r, m)
+}
+
+// 推送给 topic 绑定的所有 key，有一个成功就算成功
+func publishNtfy(w http.ResponseWriter, r *http.Request, m *ntfyMessage) {
+	logger := requestLogger(r).With("topic", m.Topic)
+	if !ntfyTopicPattern.MatchString(m.Topic) {
+		ntfyError(w, http.StatusBadRequest, "topic 只能包含字母、数字、- 和 _")
+		return
+	}
+	keys := getTopicKeys(m.Topic)
+	if len(keys) == 0 {
+		ntfyError(w, http.StatusNotFound, "topic 没有绑定任何key")
+		return
+	}
+	if len(m.Message) == 0 {
+		m.Message = "无推送文字内容"
+	}
+
+	logger.Debug("收到ntfy推送", secret("title", redactBody, m.Title), secret("body", redactBody, m.Message), "priority", m.Priority, "keys", len(keys))
+	msg := &Message{Title: m.Title, Body: m.Message, Params: ntfyParams(m)}
+	if err := pushToKeys(r.Context(), keys, clientIP(r), msg); err != nil {
+		if e, ok := err.(*limitError); ok {
+			writeLimited(w, e)
+			return
+		}
+		ntfyError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	logger.Info("推送成功", "keys", len(keys))
+
+	m.ID = newRequestID()[:12]
+	m.Time = time.Now().Unix()
+	m.Event = "message"
+	data, _ := json.Marshal(m)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintln(w, string(data))
+}
+
+// GET 列出 key 绑定的 topic
+func ntfyTopics(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	key := bone.GetValue(r, "key")
+	if !keyExists(key) {
+		fmt.Fprint(w, responseString(400, "找不到key对应的DeviceToken, 请确保Key正确! Key可在App端注册获得。"))
+		return
+	}
+	topics := []string{}
+	err := boltDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("ntfy"))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var keys []string
+			if err := json.Unmarshal(v, &keys); err != nil {
+				return err
+			}
+			for _, bound := range keys {
+				if bound == key {
+					topics = append(topics, string(k))
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		fmt.Fprint(w, responseString(500, err.Error()))
+		return
+	}
+	fmt.Fprint(w, responseData(200, topics, ""))
+}
+
+// POST/PUT 把 topic 绑定到 key，同一个 topic 可以绑定多个 key，第一个绑定的 key 是所有者；DELETE 解除绑定
+func ntfyTopic(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	key := bone.GetValue(r, "key")
+	topic := bone.GetValue(r, "topic")
+	if !keyExists(key) {
+		fmt.Fprint(w, responseString(400, "找不到key对应的DeviceToken, 请确保Key正确! Key可在App端注册获得。"))
+		return
+	}
+	if !ntfyTopicPattern.MatchString(topic) || ntfyReserved[topic] {
+		fmt.Fprint(w, responseString(400, "topic 只能包含字母、数字、- 和 _，且不能与已有的接口重名"))
+		return
+	}
+
+	if r.Method == "DELETE" {
+		found := false
+		err := updateTopicKeys(topic, func(keys []string) []string {
+			result := []string{}
+			for _, bound := range keys {
+				if bound == key {
+					found = true
+					continue
+				}
+				result = append(result, bound)
+			}
+			return result
+		})
+		if err != nil {
+			fmt.Fprint(w, responseString(500, err.Error()))
+			return
+		}
+		if !found {
+			fmt.Fprint(w, responseString(400, "key 没有绑定这个topic"))
+			return
+		}
+		fmt.Fprint(w, responseString(200, "删除成功"))
+		return
+	}
+
+	// topic 属于第一个绑定的 key（没有绑定时 topic 本身可以是 key），
+	// 其它 key 加入需要提供所有者的 key(owner) 或管理员token，避免别人把自己加进来收取推送
+	topicIsKey := keyExists(topic)
+	admin := checkAdminToken(r)
+	ownerKey := r.FormValue("owner")
+	full, forbidden := false, false
+	err := updateTopicKeys(topic, func(keys []string) []string {
+		for _, bound := range keys {
+			if bound == key {
+				return keys
+			}
+		}
+		owner := topicOwner(topic, keys, topicIsKey)
+		if len(owner) > 0 && owner != key && !admin && subtle.ConstantTimeCompare([]byte(ownerKey), []byte(owner)) != 1 {
+			forbidden = true
+			return keys
+		}
+		if len(keys) >= ntfyMaxKeys {
+			full = true
+			return keys
+		}
+		return append(keys, key)
+	})
+	if forbidden {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, responseString(403, "topic 已经属于其它key，加入需要提供所有者的key(owner)或管理员token"))
+		return
+	}
+	if full {
+		fmt.Fprint(w, responseString(400, "每个topic最多绑定 "+strconv.Itoa(ntfyMaxKeys)+" 个key"))
+		return
+	}
+	if err != nil {
+		fmt.Fprint(w, responseString(500, err.Error()))
+		return
+	}
+	fmt.Fprint(w, responseString(200, "绑定成功"))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// webhook 订阅和 webhook 设备的地址由 key 的持有者提供，服务器会从内网发起请求，
+// 默认不允许访问回环、内网、链路本地等地址，只在确实需要推送到内网服务时用 -webhook-allow-private 打开
+var WebhookAllowPrivate bool = false
+
+var errPrivateAddress = errors.New("不允许请求内网地址")
+
+// 100.64.0.0/10 运营商级 NAT，net.IP.IsPrivate 不包含
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func privateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip)
+}
+
+// 在解析完域名、真正连接之前检查地址，避免 DNS 重新绑定和重定向绕过注册时的检查
+func dialPublic(network, address string, c syscall.RawConn) error {
+	if WebhookAllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || privateIP(ip) {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+// 请求用户提供的地址时使用，不走环境变量中的代理，否则连接检查的是代理的地址
+func newPublicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second, Control: dialPublic}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// 注册时先解析一次，尽早拒绝内网地址；解析失败不拒绝，连接时还会再检查
+func checkPublicURL(u *url.URL) error {
+	if WebhookAllowPrivate {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if privateIP(addr.IP) {
+			return errPrivateAddress
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/sideshow/apns2"
+)
+
+// dry_run=1 时只生成推送请求并返回，不发送，也不计入限流和配额
+func isDryRun(r *http.Request) bool {
+	value := r.FormValue("dry_run")
+	return value == "1" || value == "true"
+}
+
+// Rules 为匹配的路由规则；Status 为 dropped 时推送会被规则丢弃，held 时会在免打扰时段结束后汇总发送，
+// 这两种情况没有 Payload；downgraded 时免打扰时段内降级为 passive，Payload 为降级后的请求
+type pushPreview struct {
+	Provider  string            `json:"provider"`
+	Token     string            `json:"token"`
+	Rules     []string          `json:"rules,omitempty"`
+	Status    string            `json:"status,omitempty"`
+	Method    string            `json:"method,omitempty"`
+	URL       string            `json:"url,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Payload   json.RawMessage   `json:"payload"`
+	Size      int               `json:"size"`
+	Truncated bool              `json:"truncated"`
+}
+
+// 与 apns2 发送时设置的请求头一致
+func apnsHeaders(n *apns2.Notification) map[string]string {
+	headers := map[string]string{}
+	if len(n.ApnsID) > 0 {
+		headers["apns-id"] = n.ApnsID
+	}
+	if len(n.CollapseID) > 0 {
+		headers["apns-collapse-id"] = n.CollapseID
+	}
+	if n.Priority > 0 {
+		headers["apns-priority"] = strconv.Itoa(n.Priority)
+	}
+	if len(n.Topic) > 0 {
+		headers["apns-topic"] = n.Topic
+	}
+	if !n.Expiration.IsZero() {
+		headers["apns-expiration"] = strconv.FormatInt(n.Expiration.Unix(), 10)
+	}
+	if len(n.PushType) > 0 {
+		headers["apns-push-type"] = string(n.PushType)
+	} else {
+		headers["apns-push-type"] = string(apns2.PushTypeAlert)
+	}
+	return headers
+}
+
+// 每个设备一条预览，APNs 设备给出完整的请求，其它推送方式给出发送的消息。
+// 与 pushToKey 一样先执行路由规则、再按免打扰时段降级，但不转发、不暂存
+func previewPush(key string, msg *Message) ([]pushPreview, error) {
+	devices, err := getDevicesByKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var matched []string
+	status := ""
+	if meta, err := getKeyMeta(key); err == nil && len(meta.Rules) > 0 {
+		result := applyRules(meta.Rules, msg)
+		matched, msg = result.Matched, result.Message
+		if result.Drop {
+			status = "dropped"
+		}
+	}
+	if len(status) == 0 {
+		switch quietMode(key, msg) {
+		case "hold":
+			status = "held"
+		case "passive":
+			status = "downgraded"
+			msg = passiveMessage(msg)
+		}
+	}
+
+	previews := []pushPreview{}
+	for _, device := range devices {
+		// 预览会返回给调用方，设备 token 和浏览器推送的订阅不论日志如何配置都只给出摘要
+		preview := pushPreview{Provider: device.Provider, Token: hashSecret(device.Token), Rules: matched, Status: status}
+		if status == "dropped" || status == "held" {
+			previews = append(previews, preview)
+			continue
+		}
+		if device.Provider == "apns" {
+			notification, truncated := buildNotification(device.Token, msg)
+			data, err := json.Marshal(notification.Payload)
+			if err != nil {
+				return nil, err
+			}
+			preview.Method = "POST"
+			preview.URL = "https://api.push.apple.com/3/device/" + preview.Token
+			preview.Headers = apnsHeaders(notification)
+			preview.Payload = data
+			preview.Truncated = truncated
+		} else {
+			preview.Payload, err = json.Marshal(msg)
+			if err != nil {
+				return nil, err
+			}
+		}
+		preview.Size = len(preview.Payload)
+		previews = append(previews, preview)
+	}
+	return previews, nil
+}
+
+func writePreview(w http.ResponseWriter, key string, msg *Message) {
+	previews, err := previewPush(key, msg)
+	if err != nil {
+		fmt.Fprint(w, responseString(500, err.Error()))
+		return
+	}
+	fmt.Fprint(w, responseData(200, previews, "预览，未发送"))
+}
+
+// 推送给多个 key 时按 key 分别预览，只有一个 key 时与 writePreview 相同
+func writeKeysPreview(w http.ResponseWriter, keys []string, msg *Message) {
+	if len(keys) == 1 {
+		writePreview(w, keys[0], msg)
+		return
+	}
+	previews := map[string][]pushPreview{}
+	for _, key := range keys {
+		list, err := previewPush(key, msg)
+		if err != nil {
+			fmt.Fprint(w, responseString(500, err.Error()))
+			return
+		}
+		previews[key] = list
+	}
+	fmt.Fprint(w, responseData(200, previews, "预览，未发送"))
+}
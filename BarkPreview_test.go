@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func setRules(t *testing.T, key string, rules []routeRule) {
+	t.Helper()
+	_, err := updateKeyMeta(key, func(meta *KeyMeta) error {
+		meta.Rules = rules
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 预览与实际推送一样经过路由规则和免打扰时段，但不会暂存
+func TestPreviewRulesAndQuietHours(t *testing.T) {
+	openTestDB(t)
+	key := "previewTestKey"
+	if err := saveDevice(key, Device{Provider: "apns", Token: strings.Repeat("ab", 32)}); err != nil {
+		t.Fatal(err)
+	}
+	setRules(t, key, []routeRule{
+		{Name: "backup", Title: "^备份", Level: "timeSensitive", SetGroup: "nas"},
+		{Name: "spam", Body: "广告", Drop: true},
+	})
+	setQuietHours(t, key, "passive")
+
+	previews, err := previewPush(key, &Message{Title: "备份失败", Body: "磁盘已满", Params: map[string]interface{}{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(previews) != 1 || previews[0].Status != "" || len(previews[0].Rules) != 1 || previews[0].Rules[0] != "backup" {
+		t.Fatalf("preview = %+v", previews)
+	}
+	content := map[string]interface{}{}
+	json.Unmarshal(previews[0].Payload, &content)
+	aps, _ := content["aps"].(map[string]interface{})
+	if aps["interruption-level"] != "time-sensitive" || content["group"] != "nas" {
+		t.Errorf("rule not applied: %s", previews[0].Payload)
+	}
+
+	previews, _ = previewPush(key, &Message{Title: "门铃", Body: "有人按门铃", Params: map[string]interface{}{"level": "active"}})
+	json.Unmarshal(previews[0].Payload, &content)
+	aps, _ = content["aps"].(map[string]interface{})
+	if previews[0].Status != "downgraded" || aps["interruption-level"] != "passive" {
+		t.Errorf("quiet hours not applied: %s %s", previews[0].Status, previews[0].Payload)
+	}
+
+	previews, _ = previewPush(key, &Message{Body: "限时广告", Params: map[string]interface{}{}})
+	if previews[0].Status != "dropped" || previews[0].Payload != nil {
+		t.Errorf("dropped preview = %+v", previews[0])
+	}
+
+	setQuietHours(t, key, "hold")
+	previews, _ = previewPush(key, &Message{Body: "hi", Params: map[string]interface{}{}})
+	if previews[0].Status != "held" {
+		t.Errorf("held preview = %+v", previews[0])
+	}
+	if held := recordCounts("held")[key]; held != 0 {
+		t.Errorf("preview held %d messages", held)
+	}
+}
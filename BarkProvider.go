@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// 一条待推送的消息，Params 为请求中的其余参数，由各个 Provider 自行决定如何使用
+type Message struct {
+	Category string                 `json:"category,omitempty"`
+	Title    string                 `json:"title,omitempty"`
+	Body     string                 `json:"body"`
+	Params   map[string]interface{} `json:"params,omitempty"`
+}
+
+// 推送通道，例如 APNs、FCM、Webhook
+type Provider interface {
+	Name() string
+	// 注册时校验推送目标(DeviceToken、URL 等)的格式
+	ValidateTarget(token string) error
+	// 发送失败时返回 *PushError 以区分可重试的错误和目标失效
+	Send(ctx context.Context, token string, msg *Message) error
+}
+
+type PushError struct {
+	Message   string
+	Reason    string
+	Permanent bool // 重试也不会成功
+	Invalid   bool // 推送目标已失效，需要从 key 上移除
+}
+
+func (e *PushError) Error() string {
+	return e.Message
+}
+
+// 允许同一个 key 下注册多个目标的 Provider，SameTarget 判断两个 token 是否指向同一个目标
+type multiTargetProvider interface {
+	SameTarget(a string, b string) bool
+}
+
+var providers = map[string]Provider{}
+
+func registerProvider(p Provider) {
+	providers[p.Name()] = p
+}
+
+// key 下注册的一个推送目标
+type Device struct {
+	Provider string `json:"provider"`
+	Token    string `json:"token"`
+}
+
+// device bucket 中早期直接存放 APNs 的 DeviceToken，现在存放 Device 数组
+func decodeDevices(val []byte) ([]Device, error) {
+	if len(val) == 0 {
+		return nil, nil
+	}
+	if val[0] != '[' {
+		return []Device{{Provider: "apns", Token: string(val)}}, nil
+	}
+	var devices []Device
+	if err := json.Unmarshal(val, &devices); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+func getDevicesByKey(key string) ([]Device, error) {
+	var devices []Device
+	err := boltDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("device"))
+		val := bucket.Get([]byte(key))
+		if val == nil {
+			return errors.New("没找到DeviceToken")
+		}
+		var err error
+		devices, err = decodeDevices(val)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// 修改 key 下的设备列表，fn 返回新的列表
+func updateDevices(key string, fn func(devices []Device) []Device) error {
+	return boltDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("device"))
+		if err != nil {
+			return err
+		}
+		devices, err := decodeDevices(bucket.Get([]byte(key)))
+		if err != nil {
+			return err
+		}
+		val, err := json.Marshal(fn(devices))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), val)
+	})
+}
+
+func keyExists(key string) bool {
+	exists := false
+	boltDB.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket([]byte("device")).Get([]byte(key)) != nil
+		return nil
+	})
+	return exists
+}
+
+// 同一个 key 下每种推送方式只保留一个目标，重新注册时替换旧的；multiTargetProvider 只替换同一个目标
+func saveDevice(key string, device Device) error {
+	multi, _ := providers[device.Provider].(multiTargetProvider)
+	return updateDevices(key, func(devices []Device) []Device {
+		result := []Device{device}
+		for _, d := range devices {
+			if d.Provider != device.Provider {
+				result = append(result, d)
+			} else if multi != nil && !multi.SameTarget(d.Token, device.Token) {
+				result = append(result, d)
+			}
+		}
+		return result
+	})
+}
+
+func removeDevice(key string, device Device) error {
+	return updateDevices(key, func(devices []Device) []Device {
+		result := []Device{}
+		for _, d := range devices {
+			if d != device {
+				result = append(result, d)
+			}
+		}
+		return result
+	})
+}
+
+// 交给推送回调的推送状态，被合并或暂存的推送还没有发送，稍后发送时会再触发一次回调
+type pushStatus string
+
+const (
+	pushSent     pushStatus = "sent"
+	pushFailed   pushStatus = "failed"
+	pushDigested pushStatus = "digested"
+	pushHeld     pushStatus = "held"
+)
+
+var pushHooksMu sync.Mutex
+var pushHooks []func(key string, msg *Message, status pushStatus, err error)
+
+// 注册每次推送完成后的回调，status 为推送状态，失败时 err 为错误。回调在推送的 goroutine 中执行，不能阻塞
+func onPush(fn func(key string, msg *Message, status pushStatus, err error)) {
+	pushHooksMu.Lock()
+	defer pushHooksMu.Unlock()
+	pushHooks = append(pushHooks, fn)
+}
+
+// 推送给 key 下的所有设备，只要有一个成功就算成功；目标失效的设备会被移除。
+// 依次经过 key 的路由规则、内容去重和合并窗口：被规则丢弃或重复的推送直接忽略，
+// 开启了合并的推送先放进合并窗口，到期后作为一条推送发出；被合并的推送同样会触发回调
+func pushToKey(ctx context.Context, key string, msg *Message) error {
+	msg, ok := routeMessage(ctx, key, msg)
+	if !ok {
+		return nil
+	}
+	dedupID, duplicate := duplicateMessage(key, msg)
+	if duplicate {
+		slog.Info("窗口内已有相同内容的推送，不再发送", secret("key", redactKey, key))
+		return nil
+	}
+	msg, digested := applyDigest(key, msg)
+	if digested {
+		runPushHooks(key, msg, pushDigested, nil)
+		return nil
+	}
+	err := deliverToKey(ctx, key, msg)
+	if err != nil {
+		forgetMessage(dedupID)
+	}
+	return err
+}
+
+// 跳过合并直接推送，免打扰时段内的推送可能被暂存或降级，暂存的推送同样会触发回调
+func deliverToKey(ctx context.Context, key string, msg *Message) error {
+	msg, held := applyQuietHours(key, msg)
+	if held {
+		runPushHooks(key, msg, pushHeld, nil)
+		return nil
+	}
+	err := pushToDevices(ctx, key, msg)
+	status := pushSent
+	if err != nil {
+		status = pushFailed
+	}
+	runPushHooks(key, msg, status, err)
+	return err
+}
+
+func runPushHooks(key string, msg *Message, status pushStatus, err error) {
+	pushHooksMu.Lock()
+	hooks := pushHooks
+	pushHooksMu.Unlock()
+	for _, hook := range hooks {
+		hook(key, msg, status, err)
+	}
+}
+
+// 推送给多个 key（例如一个 topic 绑定的所有 key），每个 key 单独限流。
+// 有一个成功就返回 nil；全部被限流时返回 *limitError，否则返回最后一个推送错误
+func pushToKeys(ctx context.Context, keys []string, ip string, msg *Message) error {
+	logger := slog.Default()
+	ctx = withClientIP(ctx, ip)
+	var lastErr error
+	var limited *limitError
+	sent := 0
+	for _, key := range keys {
+		if e := checkLimit(key, ip); e != nil {
+			logger.Warn("推送被限制", secret("key", redactKey, key), "reason", e.Message, "retry_after", e.RetryAfter)
+			limited = e
+			continue
+		}
+		if err := pushToKey(ctx, key, msg); err != nil {
+			logger.Warn("推送失败", secret("key", redactKey, key), "err", err)
+			lastErr = err
+			continue
+		}
+		sent++
+	}
+	switch {
+	case sent > 0:
+		return nil
+	case lastErr != nil:
+		return lastErr
+	case limited != nil:
+		return limited
+	}
+	return errors.New("没有可以推送的key")
+}
+
+func pushToDevices(ctx context.Context, key string, msg *Message) error {
+	devices, err := getDevicesByKey(key)
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		return errors.New("key下没有可用的设备，请在App端重新注册")
+	}
+
+	logger := slog.Default().With(secret("key", redactKey, key))
+	var lastErr error
+	sent := 0
+	for _, device := range devices {
+		provider := providers[device.Provider]
+		if provider == nil {
+			lastErr = errors.New("服务器未启用推送方式 " + device.Provider)
+			continue
+		}
+
+		start := time.Now()
+		err := provider.Send(ctx, device.Token, msg)
+		reason := "Success"
+		if pe, ok := err.(*PushError); ok {
+			reason = pe.Reason
+		} else if err != nil {
+			reason = "Error"
+		}
+		observePush(device.Provider, start, reason)
+
+		if err == nil {
+			sent++
+			continue
+		}
+		lastErr = err
+		logger.Warn("推送失败", "provider", device.Provider, secret("token", redactToken, device.Token), "reason", reason, "err", err)
+		if pe, ok := err.(*PushError); ok && pe.Invalid {
+			if err := removeDevice(key, device); err != nil {
+				logger.Error("移除失效设备失败", "provider", device.Provider, "err", err)
+			} else {
+				logger.Info("已移除失效设备", "provider", device.Provider, secret("token", redactToken, device.Token))
+			}
+		}
+	}
+	if sent > 0 {
+		return nil
+	}
+	return lastErr
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type pushErrorCase struct {
+	name      string
+	status    int
+	body      string
+	wantErr   bool
+	permanent bool
+	invalid   bool
+}
+
+func checkPushError(t *testing.T, c pushErrorCase, err error) {
+	t.Helper()
+	if !c.wantErr {
+		if err != nil {
+			t.Errorf("%s: err = %v, want nil", c.name, err)
+		}
+		return
+	}
+	var e *PushError
+	if !errors.As(err, &e) {
+		t.Errorf("%s: err = %v, want *PushError", c.name, err)
+		return
+	}
+	if e.Permanent != c.permanent || e.Invalid != c.invalid {
+		t.Errorf("%s: permanent = %v, invalid = %v, want %v, %v", c.name, e.Permanent, e.Invalid, c.permanent, c.invalid)
+	}
+}
+
+func fakeProviderServer(t *testing.T, status int, body string, received func(r *http.Request)) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if received != nil {
+			received(r)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func allowPrivateWebhooks(t *testing.T, allow bool) {
+	old := WebhookAllowPrivate
+	WebhookAllowPrivate = allow
+	t.Cleanup(func() { WebhookAllowPrivate = old })
+}
+
+// 404/410 说明地址已失效，429/5xx 可以重试，其它 4xx 重试也不会成功
+func TestWebhookProviderErrors(t *testing.T) {
+	allowPrivateWebhooks(t, true)
+	cases := []pushErrorCase{
+		{name: "ok", status: http.StatusOK},
+		{name: "no content", status: http.StatusNoContent},
+		{name: "not found", status: http.StatusNotFound, wantErr: true, permanent: true, invalid: true},
+		{name: "gone", status: http.StatusGone, wantErr: true, permanent: true, invalid: true},
+		{name: "too many requests", status: http.StatusTooManyRequests, wantErr: true},
+		{name: "server error", status: http.StatusInternalServerError, wantErr: true},
+		{name: "unavailable", status: http.StatusServiceUnavailable, wantErr: true},
+		{name: "bad request", status: http.StatusBadRequest, wantErr: true, permanent: true},
+		{name: "unauthorized", status: http.StatusUnauthorized, wantErr: true, permanent: true},
+	}
+	p := newWebhookProvider()
+	for _, c := range cases {
+		var got *Message
+		srv := fakeProviderServer(t, c.status, "", func(r *http.Request) {
+			got = &Message{}
+			json.NewDecoder(r.Body).Decode(got)
+		})
+		err := p.Send(context.Background(), srv.URL, &Message{Title: "标题", Body: "内容"})
+		checkPushError(t, c, err)
+		if got == nil || got.Title != "标题" || got.Body != "内容" {
+			t.Errorf("%s: server received %+v", c.name, got)
+		}
+	}
+}
+
+func TestWebhookProviderTransportError(t *testing.T) {
+	allowPrivateWebhooks(t, true)
+	srv := fakeProviderServer(t, http.StatusOK, "", nil)
+	url := srv.URL
+	srv.Close()
+	err := newWebhookProvider().Send(context.Background(), url, &Message{Body: "hi"})
+	checkPushError(t, pushErrorCase{name: "closed", wantErr: true}, err)
+}
+
+func TestWebhookProviderPrivateAddress(t *testing.T) {
+	allowPrivateWebhooks(t, false)
+	p := newWebhookProvider()
+	for _, target := range []string{"http://127.0.0.1:8080/", "http://[::1]/", "http://10.0.0.1/", "http://169.254.169.254/latest", "http://100.64.0.1/"} {
+		if err := p.ValidateTarget(target); err == nil {
+			t.Errorf("ValidateTarget(%s) = nil, want error", target)
+		}
+	}
+	if err := p.ValidateTarget("https://93.184.216.34/hook"); err != nil {
+		t.Errorf("ValidateTarget(public) = %v, want nil", err)
+	}
+
+	// 注册后地址变成内网的，发送时同样拒绝
+	called := false
+	srv := fakeProviderServer(t, http.StatusOK, "", func(r *http.Request) { called = true })
+	err := p.Send(context.Background(), srv.URL, &Message{Body: "hi"})
+	checkPushError(t, pushErrorCase{name: "private", wantErr: true, permanent: true}, err)
+	if called {
+		t.Error("request reached a private address")
+	}
+}
+
+func TestFCMProviderErrors(t *testing.T) {
+	unregistered := `{"error":{"code":404,"message":"Requested entity was not found.","status":"NOT_FOUND","details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"UNREGISTERED"}]}}`
+	cases := []pushErrorCase{
+		{name: "ok", status: http.StatusOK, body: `{"name":"projects/p/messages/1"}`},
+		{name: "unregistered", status: http.StatusNotFound, body: unregistered, wantErr: true, permanent: true, invalid: true},
+		{name: "not found", status: http.StatusNotFound, wantErr: true, permanent: true, invalid: true},
+		{name: "gone", status: http.StatusGone, wantErr: true, permanent: true, invalid: true},
+		{name: "sender mismatch", status: http.StatusForbidden, body: `{"error":{"code":403,"status":"PERMISSION_DENIED","details":[{"errorCode":"SENDER_ID_MISMATCH"}]}}`, wantErr: true, permanent: true, invalid: true},
+		{name: "quota", status: http.StatusTooManyRequests, body: `{"error":{"code":429,"status":"RESOURCE_EXHAUSTED","details":[{"errorCode":"QUOTA_EXCEEDED"}]}}`, wantErr: true},
+		{name: "internal", status: http.StatusInternalServerError, body: `{"error":{"code":500,"status":"INTERNAL"}}`, wantErr: true},
+		{name: "unavailable", status: http.StatusServiceUnavailable, wantErr: true},
+		{name: "invalid argument", status: http.StatusBadRequest, body: `{"error":{"code":400,"status":"INVALID_ARGUMENT","details":[{"errorCode":"INVALID_ARGUMENT"}]}}`, wantErr: true, permanent: true},
+	}
+	for _, c := range cases {
+		var token string
+		srv := fakeProviderServer(t, c.status, c.body, func(r *http.Request) {
+			req := struct {
+				Message fcmMessage `json:"message"`
+			}{}
+			json.NewDecoder(r.Body).Decode(&req)
+			token = req.Message.Token
+		})
+		p := &fcmProvider{url: srv.URL, client: srv.Client()}
+		err := p.Send(context.Background(), "fcm-token", &Message{Body: "hi", Params: map[string]interface{}{}})
+		checkPushError(t, c, err)
+		if token != "fcm-token" {
+			t.Errorf("%s: token = %q, want fcm-token", c.name, token)
+		}
+	}
+}
+
+func webPushSubscription(t *testing.T, endpoint string) string {
+	t.Helper()
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, _ := json.Marshal(map[string]interface{}{
+		"endpoint": endpoint,
+		"keys": map[string]string{
+			"p256dh": base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()),
+			"auth":   base64.RawURLEncoding.EncodeToString(make([]byte, 16)),
+		},
+	})
+	return string(sub)
+}
+
+func TestWebPushProviderPrivateAddress(t *testing.T) {
+	openTestDB(t)
+	allowPrivateWebhooks(t, false)
+	p, err := newWebPushProvider("mailto:admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, endpoint := range []string{"https://127.0.0.1/push", "https://10.0.0.1/push", "https://[::1]/push", "https://169.254.169.254/latest"} {
+		if err := p.ValidateTarget(webPushSubscription(t, endpoint)); err == nil {
+			t.Errorf("ValidateTarget(%s) = nil, want error", endpoint)
+		}
+	}
+	if err := p.ValidateTarget(webPushSubscription(t, "https://93.184.216.34/push")); err != nil {
+		t.Errorf("ValidateTarget(public) = %v, want nil", err)
+	}
+
+	called := false
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+	t.Cleanup(srv.Close)
+	err = p.Send(context.Background(), webPushSubscription(t, srv.URL), &Message{Body: "hi"})
+	checkPushError(t, pushErrorCase{name: "private", wantErr: true, permanent: true}, err)
+	if called {
+		t.Error("request reached a private address")
+	}
+}
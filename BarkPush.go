@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// 一次最多推送给多少个 key
+const pushMaxKeys = 100
+
+// POST /push，以 JSON 提交推送，适合客户端调用：
+// {"device_key": "...", "device_keys": [...], "title": "...", "body": "...", "category": "...", "sound": "...", ...}
+// 除 device_key(s)、title、body、category 外的字段都作为推送参数，与 URL 参数的含义一致
+func pushJSON(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	logger := requestLogger(r)
+
+	req := map[string]interface{}{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+		fmt.Fprint(w, responseString(400, "JSON 格式不正确"))
+		return
+	}
+
+	var keys []string
+	if key, ok := req["device_key"].(string); ok && len(key) > 0 {
+		keys = append(keys, key)
+	}
+	if list, ok := req["device_keys"].([]interface{}); ok {
+		for _, item := range list {
+			if key, ok := item.(string); ok && len(key) > 0 {
+				keys = append(keys, key)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		fmt.Fprint(w, responseString(400, "缺少 device_key"))
+		return
+	}
+	if len(keys) > pushMaxKeys {
+		fmt.Fprint(w, responseString(400, "device_keys 不能超过 100 个"))
+		return
+	}
+	for _, key := range keys {
+		if !keyExists(key) {
+			fmt.Fprint(w, responseString(400, "找不到key对应的DeviceToken, 请确保Key正确! Key可在App端注册获得。"))
+			return
+		}
+	}
+
+	msg := jsonMessage(req)
+	dryRun := isDryRun(r) || req["dry_run"] == true
+	logger.Debug("收到推送", "category", msg.Category, secret("title", redactBody, msg.Title), secret("body", redactBody, msg.Body), "keys", len(keys))
+
+	if dryRun {
+		writeKeysPreview(w, keys, msg)
+		return
+	}
+
+	if err := pushToKeys(r.Context(), keys, clientIP(r), msg); err != nil {
+		if e, ok := err.(*limitError); ok {
+			writeLimited(w, e)
+			return
+		}
+		logger.Warn("推送失败", "err", err)
+		fmt.Fprint(w, responseString(400, err.Error()))
+		return
+	}
+	logger.Info("推送成功", "keys", len(keys))
+	fmt.Fprint(w, responseString(200, ""))
+}
+
+// 按 /push 的字段生成推送，device_key(s)、dry_run 等控制字段不会放进推送参数
+func jsonMessage(req map[string]interface{}) *Message {
+	msg := &Message{Params: map[string]interface{}{}}
+	for name, value := range req {
+		switch strings.ToLower(name) {
+		case "device_key", "device_keys", "dry_run":
+		case "title":
+			msg.Title, _ = value.(string)
+		case "body":
+			msg.Body, _ = value.(string)
+		case "category":
+			msg.Category, _ = value.(string)
+		default:
+			if value != nil {
+				msg.Params[strings.ToLower(name)] = value
+			}
+		}
+	}
+	if len(msg.Body) <= 0 {
+		msg.Body = "无推送文字内容"
+	}
+	return msg
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/go-zoo/bone"
+)
+
+// 免打扰时段，保存在 key 的 KeyMeta 中。时段内打扰程度低于 Threshold 的推送
+// 按 Mode 处理：hold 暂存起来，时段结束后合并成一条汇总推送；passive 降级为不打扰的通知
+type QuietHours struct {
+	Timezone  string      `json:"timezone"`
+	Rules     []quietRule `json:"rules"`
+	Threshold string      `json:"threshold"`
+	Mode      string      `json:"mode"`
+}
+
+// Days 为空表示每天，Start 大于 End 时跨越午夜，Days 指开始的那一天
+type quietRule struct {
+	Days  []string `json:"days,omitempty"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+}
+
+// 打扰程度从低到高，与 Bark 的 level 参数一致
+var levelRank = map[string]int{"passive": 0, "active": 1, "timeSensitive": 2, "critical": 3}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// 每个 key 最多暂存的推送数，超过后丢弃最早的
+const quietHeldLimit = 500
+
+// 汇总推送中最多列出的条数
+const quietSummaryLines = 10
+
+// 汇总推送最多尝试的次数，超过后丢弃暂存的推送
+const quietMaxAttempts = 5
+
+// 每个 key 发送汇总失败的次数，只在 runQuietHours 的 goroutine 中访问
+var heldAttempts = map[string]int{}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.New("时间格式应为 HH:MM")
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (q *QuietHours) validate() error {
+	if _, err := time.LoadLocation(q.Timezone); err != nil {
+		return errors.New("timezone 不正确: " + q.Timezone)
+	}
+	if len(q.Rules) == 0 {
+		return errors.New("至少需要一个时段")
+	}
+	for _, rule := range q.Rules {
+		if _, err := parseClock(rule.Start); err != nil {
+			return err
+		}
+		if _, err := parseClock(rule.End); err != nil {
+			return err
+		}
+		for _, day := range rule.Days {
+			if _, ok := weekdays[strings.ToLower(day)]; !ok {
+				return errors.New("days 只能是 mon,tue,wed,thu,fri,sat,sun")
+			}
+		}
+	}
+	if _, ok := levelRank[q.Threshold]; !ok {
+		return errors.New("threshold 只能是 passive、active、timeSensitive 或 critical")
+	}
+	if q.Mode != "hold" && q.Mode != "passive" {
+		return errors.New("mode 只能是 hold 或 passive")
+	}
+	return nil
+}
+
+func (rule quietRule) on(day time.Weekday) bool {
+	if len(rule.Days) == 0 {
+		return true
+	}
+	for _, d := range rule.Days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// 判断 now 是否在免打扰时段内
+func (q *QuietHours) active(now time.Time) bool {
+	loc, err := time.LoadLocation(q.Timezone)
+	if err != nil {
+		return false
+	}
+	now = now.In(loc)
+	minutes := now.Hour()*60 + now.Minute()
+	yesterday := now.AddDate(0, 0, -1).Weekday()
+	for _, rule := range q.Rules {
+		start, _ := parseClock(rule.Start)
+		end, _ := parseClock(rule.End)
+		switch {
+		case start == end:
+			if rule.on(now.Weekday()) {
+				return true
+			}
+		case start < end:
+			if rule.on(now.Weekday()) && minutes >= start && minutes < end {
+				return true
+			}
+		default:
+			if (rule.on(now.Weekday()) && minutes >= start) || (rule.on(yesterday) && minutes < end) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func messageLevel(msg *Message) string {
+	if level, ok := msg.Params["level"].(string); ok {
+		if _, ok := levelRank[level]; ok {
+			return level
+		}
+	}
+	return "active"
+}
+
+// 现在推送给 key 时免打扰时段的处理方式：hold、passive，不受影响时返回空字符串
+func quietMode(key string, msg *Message) string {
+	meta, err := getKeyMeta(key)
+	if err != nil || meta.Quiet == nil || !meta.Quiet.active(time.Now()) {
+		return ""
+	}
+	if levelRank[messageLevel(msg)] >= levelRank[meta.Quiet.Threshold] {
+		return ""
+	}
+	return meta.Quiet.Mode
+}
+
+// 复制一份降级为 passive 的消息，不修改传入的 msg
+func passiveMessage(msg *Message) *Message {
+	passive := *msg
+	passive.Params = map[string]interface{}{}
+	for name, value := range msg.Params {
+		passive.Params[name] = value
+	}
+	passive.Params["level"] = "passive"
+	return &passive
+}
+
+// 在 pushToKey 中调用：返回实际要发送的消息，held 为 true 时消息已暂存，不需要发送
+func applyQuietHours(key string, msg *Message) (*Message, bool) {
+	logger := slog.Default().With(secret("key", redactKey, key))
+	switch quietMode(key, msg) {
+	case "hold":
+		if _, err := appendRecord("held", key, msg, quietHeldLimit); err != nil {
+			// 暂存失败时宁可打扰也不丢消息
+			logger.Error("暂存免打扰期间的推送失败", "err", err)
+			return msg, false
+		}
+		logger.Debug("免打扰时段内，推送已暂存")
+		return msg, true
+	case "passive":
+		logger.Debug("免打扰时段内，推送降级为 passive")
+		return passiveMessage(msg), false
+	}
+	return msg, false
+}
+
+// 时段结束后把暂存的推送合并成一条发出，发送失败的下次再试，
+// 连续失败 quietMaxAttempts 次或 key 下已经没有设备时丢弃
+func deliverHeld() {
+	for key, count := range recordCounts("held") {
+		logger := slog.Default().With(secret("key", redactKey, key))
+		if !keyExists(key) {
+			deleteRecords("held", key, ^uint64(0))
+			delete(heldAttempts, key)
+			continue
+		}
+		meta, err := getKeyMeta(key)
+		if err != nil || (meta.Quiet != nil && meta.Quiet.active(time.Now())) {
+			continue
+		}
+		if devices, err := getDevicesByKey(key); err == nil && len(devices) == 0 {
+			logger.Warn("key下没有设备，丢弃暂存的推送", "count", count)
+			deleteRecords("held", key, ^uint64(0))
+			delete(heldAttempts, key)
+			continue
+		}
+
+		var lines []string
+		var last uint64
+		err = listRecords("held", key, 0, 0, func(seq uint64, val []byte) error {
+			last = seq
+			msg := &Message{}
+			if err := json.Unmarshal(val, msg); err != nil {
+				return err
+			}
+			if len(lines) < quietSummaryLines {
+				line := msg.Body
+				if len(msg.Title) > 0 {
+					line = msg.Title + ": " + line
+				}
+				lines = append(lines, truncate(firstLine(line), 80))
+			}
+			return nil
+		})
+		if err != nil {
+			logger.Error("读取暂存的推送失败", "err", err)
+			continue
+		}
+		if count > len(lines) {
+			lines = append(lines, "…还有 "+strconv.Itoa(count-len(lines))+" 条")
+		}
+
+		summary := &Message{
+			Title:  "免打扰期间的 " + strconv.Itoa(count) + " 条通知",
+			Body:   strings.Join(lines, "\n"),
+			Params: map[string]interface{}{"group": "quiet-hours"},
+		}
+		err = deliverToKey(context.Background(), key, summary)
+		if err != nil {
+			heldAttempts[key]++
+			if heldAttempts[key] < quietMaxAttempts {
+				logger.Warn("发送免打扰汇总失败，稍后重试", "attempt", heldAttempts[key], "err", err)
+				continue
+			}
+			logger.Error("发送免打扰汇总失败，已放弃", "count", count, "attempt", heldAttempts[key], "err", err)
+		} else {
+			logger.Info("已发送免打扰汇总", "count", count)
+		}
+		delete(heldAttempts, key)
+		if err := deleteRecords("held", key, last); err != nil {
+			logger.Error("删除暂存的推送失败", "err", err)
+		}
+	}
+}
+
+func runQuietHours() {
+	registerQueue("quiet_hours", func() int {
+		total := 0
+		for _, count := range recordCounts("held") {
+			total += count
+		}
+		return total
+	})
+	for range time.Tick(time.Minute) {
+		deliverHeld()
+	}
+}
+
+// GET 查看、POST 设置、DELETE 取消 key 的免打扰时段。
+// POST 可以是 QuietHours 的 JSON，或者 timezone、start、end、days、threshold、mode 表单设置单个时段
+func quietHours(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	key := bone.GetValue(r, "key")
+	if !keyExists(key) {
+		fmt.Fprint(w, responseString(400, "找不到key对应的DeviceToken, 请确保Key正确! Key可在App端注册获得。"))
+		return
+	}
+
+	var meta *KeyMeta
+	var err error
+	switch r.Method {
+	case "POST", "PUT":
+		q := &QuietHours{}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(q); err != nil {
+				fmt.Fprint(w, responseString(400, "JSON 格式不正确"))
+				return
+			}
+		} else {
+			r.ParseForm()
+			q.Timezone = r.FormValue("timezone")
+			q.Threshold = r.FormValue("threshold")
+			q.Mode = r.FormValue("mode")
+			rule := quietRule{Start: r.FormValue("start"), End: r.FormValue("end")}
+			if days := r.FormValue("days"); len(days) > 0 {
+				rule.Days = splitKeys(days)
+			}
+			q.Rules = []quietRule{rule}
+		}
+		if len(q.Timezone) == 0 {
+			q.Timezone = "Local"
+		}
+		if len(q.Threshold) == 0 {
+			q.Threshold = "timeSensitive"
+		}
+		if len(q.Mode) == 0 {
+			q.Mode = "hold"
+		}
+		if err := q.validate(); err != nil {
+			fmt.Fprint(w, responseString(400, err.Error()))
+			return
+		}
+		meta, err = updateKeyMeta(key, func(meta *KeyMeta) error {
+			meta.Quiet = q
+			return nil
+		})
+	case "DELETE":
+		meta, err = updateKeyMeta(key, func(meta *KeyMeta) error {
+			meta.Quiet = nil
+			return nil
+		})
+	default:
+		meta, err = getKeyMeta(key)
+	}
+	if err != nil {
+		fmt.Fprint(w, responseString(500, err.Error()))
+		return
+	}
+	fmt.Fprint(w, responseData(200, map[string]interface{}{
+		"quiet":  meta.Quiet,
+		"active": meta.Quiet != nil && meta.Quiet.active(time.Now()),
+		"held":   recordCounts("held")[key],
+	}, ""))
+}
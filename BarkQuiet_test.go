@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// 全天生效的免打扰时段
+func setQuietHours(t *testing.T, key string, mode string) {
+	t.Helper()
+	_, err := updateKeyMeta(key, func(meta *KeyMeta) error {
+		meta.Quiet = &QuietHours{Timezone: "UTC", Rules: []quietRule{{Start: "00:00", End: "00:00"}}, Threshold: "timeSensitive", Mode: mode}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuietHoursPassive(t *testing.T) {
+	openTestDB(t)
+	key := "quietTestKey01"
+	if err := saveDevice(key, Device{Provider: "apns", Token: strings.Repeat("ab", 32)}); err != nil {
+		t.Fatal(err)
+	}
+	setQuietHours(t, key, "passive")
+
+	msg := &Message{Body: "hi", Params: map[string]interface{}{"level": "active", "group": "g"}}
+	downgraded, held := applyQuietHours(key, msg)
+	if held {
+		t.Fatal("passive mode should not hold the message")
+	}
+	aps, content := apnsPayload(t, downgraded)
+	if aps["interruption-level"] != "passive" {
+		t.Errorf("interruption-level = %v, want passive", aps["interruption-level"])
+	}
+	if content["group"] != "g" {
+		t.Errorf("group = %v, want g", content["group"])
+	}
+	if msg.Params["level"] != "active" {
+		t.Errorf("original level changed to %v", msg.Params["level"])
+	}
+
+	// 达到阈值的推送不降级
+	urgent, _ := applyQuietHours(key, &Message{Body: "hi", Params: map[string]interface{}{"level": "critical"}})
+	if aps, _ := apnsPayload(t, urgent); aps["interruption-level"] != "critical" {
+		t.Errorf("critical: interruption-level = %v, want critical", aps["interruption-level"])
+	}
+}
+
+func TestDeliverHeldGivesUp(t *testing.T) {
+	openTestDB(t)
+	allowPrivateWebhooks(t, true)
+	registerProvider(newWebhookProvider())
+
+	calls := 0
+	srv := fakeProviderServer(t, http.StatusInternalServerError, "", func(r *http.Request) { calls++ })
+	failing := "quietTestKey02"
+	if err := saveDevice(failing, Device{Provider: "webhook", Token: srv.URL}); err != nil {
+		t.Fatal(err)
+	}
+	// key 还在，但设备都已移除
+	empty := "quietTestKey03"
+	if err := updateDevices(empty, func([]Device) []Device { return []Device{} }); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{failing, empty} {
+		if _, err := appendRecord("held", key, &Message{Title: "门铃", Body: "有人按门铃"}, quietHeldLimit); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 1; i <= quietMaxAttempts; i++ {
+		deliverHeld()
+		counts := recordCounts("held")
+		if counts[empty] != 0 {
+			t.Errorf("attempt %d: %d held records for a key without devices", i, counts[empty])
+		}
+		if want := 1; i < quietMaxAttempts && counts[failing] != want {
+			t.Errorf("attempt %d: held = %d, want %d", i, counts[failing], want)
+		}
+	}
+	if calls != quietMaxAttempts {
+		t.Errorf("summary sent %d times, want %d", calls, quietMaxAttempts)
+	}
+	if counts := recordCounts("held"); counts[failing] != 0 {
+		t.Errorf("held = %d after %d failed attempts, want 0", counts[failing], quietMaxAttempts)
+	}
+	if _, ok := heldAttempts[failing]; ok {
+		t.Error("attempt count was not cleared")
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// 按 id 区分的令牌桶限流，rate 为每秒补充的令牌数，rate <= 0 时不限制
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	l := &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+	if rate > 0 {
+		go func() {
+			for range time.Tick(time.Minute) {
+				l.cleanup()
+			}
+		}()
+	}
+	return l
+}
+
+// 取一个令牌，取不到时返回需要等待的时间
+func (l *rateLimiter) take(id string) (bool, time.Duration) {
+	if l == nil || l.rate <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b := l.buckets[id]
+	if b == nil {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[id] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// 退还 take 取走的令牌，用于后面的检查没有通过、推送实际没有发出的情况
+func (l *rateLimiter) refund(id string) {
+	if l == nil || l.rate <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b := l.buckets[id]; b != nil {
+		b.tokens = math.Min(l.burst, b.tokens+1)
+	}
+}
+
+// 清理已经补满的桶，避免 map 无限增长
+func (l *rateLimiter) cleanup() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for id, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, id)
+		}
+	}
+}
+
+type limitError struct {
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *limitError) Error() string {
+	return e.Message
+}
+
+// 推送前依次检查 key、来源 IP、全局的频率限制以及 key 的每日配额。
+// 任何一项没有通过时，前面已经取走的令牌都要退还，被拒绝的推送不占用其它限制的额度
+func checkLimit(key string, ip string) *limitError {
+	var e *limitError
+	limits := []struct {
+		limiter *rateLimiter
+		id      string
+		message string
+	}{
+		{keyLimiter, key, "推送过于频繁，请稍后再试"},
+		{ipLimiter, ip, "来源IP请求过于频繁，请稍后再试"},
+		{globalLimiter, "", "服务器繁忙，请稍后再试"},
+	}
+	taken := 0
+	for _, limit := range limits {
+		ok, wait := limit.limiter.take(limit.id)
+		if !ok {
+			e = &limitError{limit.message, wait}
+			break
+		}
+		taken++
+	}
+	defer func() {
+		if e != nil {
+			for _, limit := range limits[:taken] {
+				limit.limiter.refund(limit.id)
+			}
+		}
+	}()
+
+	now := time.Now()
+	day := now.Format("2006-01-02")
+	_, err := updateKeyMeta(key, func(meta *KeyMeta) error {
+		if meta.Day != day {
+			meta.Day = day
+			meta.DayCount = 0
+		}
+		if e == nil {
+			quota := meta.DailyQuota
+			if quota == 0 {
+				quota = DailyQuota
+			}
+			if quota > 0 && meta.DayCount >= quota {
+				tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+				e = &limitError{"已超过今日推送配额 " + strconv.Itoa(quota), tomorrow.Sub(now)}
+			}
+		}
+		if e != nil {
+			meta.LimitedCount++
+			return nil
+		}
+		meta.DayCount++
+		meta.TotalCount++
+		meta.LastPushAt = now
+		return nil
+	})
+	if err != nil && e == nil {
+		// 计数写入失败不影响推送
+		slog.Warn("更新key计数失败", secret("key", redactKey, key), "err", err)
+	}
+	return e
+}
+
+func writeLimited(w http.ResponseWriter, e *limitError) {
+	seconds := int(math.Ceil(e.RetryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprint(w, responseString(429, e.Message))
+}
+
+type clientIPKey struct{}
+
+// 在 context 中记下推送的来源 IP，路由规则转发推送时按同一个来源限流
+func withClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+func contextClientIP(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
+
+// X-Forwarded-For 最左边的地址可以由客户端随意填写，只有代理追加在右边的地址可信。
+// 从右往左跳过反向代理自己的内网地址，第一个公网地址就是来源IP；全部是内网地址时取最左边的
+func clientIP(r *http.Request) string {
+	if TrustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); len(forwarded) > 0 {
+			hops := strings.Split(forwarded, ",")
+			for i := len(hops) - 1; i >= 0; i-- {
+				hop := strings.TrimSpace(hops[i])
+				if ip := net.ParseIP(hop); ip == nil || !privateIP(ip) {
+					return hop
+				}
+			}
+			return strings.TrimSpace(hops[0])
+		}
+		if realIP := r.Header.Get("X-Real-IP"); len(realIP) > 0 {
+			return realIP
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func setLimiters(t *testing.T, key, ip, global *rateLimiter) {
+	oldKey, oldIP, oldGlobal := keyLimiter, ipLimiter, globalLimiter
+	keyLimiter, ipLimiter, globalLimiter = key, ip, global
+	t.Cleanup(func() { keyLimiter, ipLimiter, globalLimiter = oldKey, oldIP, oldGlobal })
+}
+
+// 被来源 IP 限制拒绝的推送不能占用 key 的令牌
+func TestCheckLimitRefund(t *testing.T) {
+	openTestDB(t)
+	setLimiters(t, newRateLimiter(0.001, 3), newRateLimiter(0.001, 1), nil)
+	key := "limitTestKey01"
+
+	if e := checkLimit(key, "203.0.113.1"); e != nil {
+		t.Fatalf("first push limited: %v", e)
+	}
+	for i := 0; i < 5; i++ {
+		if e := checkLimit(key, "203.0.113.1"); e == nil || e.Message != "来源IP请求过于频繁，请稍后再试" {
+			t.Fatalf("push %d from the same IP = %v, want IP limit", i, e)
+		}
+	}
+	for i := 2; i <= 3; i++ {
+		if e := checkLimit(key, "203.0.113."+strconv.Itoa(i)); e != nil {
+			t.Fatalf("push from 203.0.113.%d limited: %v", i, e)
+		}
+	}
+	if e := checkLimit(key, "203.0.113.9"); e == nil || e.Message != "推送过于频繁，请稍后再试" {
+		t.Fatalf("fourth push = %v, want key limit", e)
+	}
+
+	meta, err := getKeyMeta(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.DayCount != 3 || meta.LimitedCount != 6 {
+		t.Errorf("day count = %d, limited = %d, want 3, 6", meta.DayCount, meta.LimitedCount)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	old := TrustProxy
+	t.Cleanup(func() { TrustProxy = old })
+
+	cases := []struct {
+		trust     bool
+		forwarded string
+		want      string
+	}{
+		{false, "198.51.100.7", "192.0.2.1"},
+		{true, "", "192.0.2.1"},
+		{true, "198.51.100.7", "198.51.100.7"},
+		// 客户端伪造的最左边的地址不可信
+		{true, "1.1.1.1, 198.51.100.7", "198.51.100.7"},
+		{true, "1.1.1.1, 198.51.100.7, 10.0.0.2", "198.51.100.7"},
+		{true, "198.51.100.7, 10.0.0.2, 127.0.0.1", "198.51.100.7"},
+		{true, "10.0.0.5, 10.0.0.2", "10.0.0.5"},
+	}
+	for _, c := range cases {
+		TrustProxy = c.trust
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		if len(c.forwarded) > 0 {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if got := clientIP(r); got != c.want {
+			t.Errorf("trust %v, X-Forwarded-For %q: clientIP = %s, want %s", c.trust, c.forwarded, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-zoo/bone"
+)
+
+// key 的路由规则，保存在 KeyMeta 中，推送前按顺序执行。
+// Category 精确匹配，Title、Body、Group 是正则，全部满足才算匹配；空的条件不检查。
+// 匹配后依次改写标题和内容、设置 sound、level、group，转发给 Forward 中的 key 或 ntfy topic，
+// Drop 为 true 时不再推送给当前 key，Stop 为 true 时不再执行后面的规则
+type routeRule struct {
+	Name     string   `json:"name"`
+	Category string   `json:"category,omitempty"`
+	Title    string   `json:"title,omitempty"`
+	Body     string   `json:"body,omitempty"`
+	Group    string   `json:"group,omitempty"`
+	SetTitle *string  `json:"set_title,omitempty"`
+	SetBody  *string  `json:"set_body,omitempty"`
+	Sound    string   `json:"sound,omitempty"`
+	Level    string   `json:"level,omitempty"`
+	SetGroup string   `json:"set_group,omitempty"`
+	Forward  []string `json:"forward,omitempty"`
+	Drop     bool     `json:"drop,omitempty"`
+	Stop     bool     `json:"stop,omitempty"`
+}
+
+type ruleResult struct {
+	Message *Message `json:"message"`
+	Matched []string `json:"matched"`
+	Forward []string `json:"forward"`
+	Drop    bool     `json:"drop"`
+}
+
+const maxRules = 50
+
+// 转发的层数，超过后不再转发，避免规则互相转发形成循环
+const maxForwardDepth = 3
+
+type forwardChainKey struct{}
+
+// 编译过的正则，规则保存时编译，推送时直接使用；数量过多时清空重新编译
+const maxRuleRegexps = 10000
+
+var ruleRegexpsMu sync.Mutex
+var ruleRegexps = map[string]*regexp.Regexp{}
+
+func compileRule(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) == 0 {
+		return nil, nil
+	}
+	ruleRegexpsMu.Lock()
+	defer ruleRegexpsMu.Unlock()
+	if re, ok := ruleRegexps[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(ruleRegexps) >= maxRuleRegexps {
+		ruleRegexps = map[string]*regexp.Regexp{}
+	}
+	ruleRegexps[pattern] = re
+	return re, nil
+}
+
+func validateRules(rules []routeRule) error {
+	if len(rules) > maxRules {
+		return errors.New("最多只能设置 " + strconv.Itoa(maxRules) + " 条规则")
+	}
+	for i, rule := range rules {
+		name := rule.Name
+		if len(name) == 0 {
+			name = "#" + strconv.Itoa(i+1)
+		}
+		for _, pattern := range []string{rule.Title, rule.Body, rule.Group} {
+			if _, err := compileRule(pattern); err != nil {
+				return errors.New("规则 " + name + " 的正则不正确: " + err.Error())
+			}
+		}
+		if _, ok := levelRank[rule.Level]; len(rule.Level) > 0 && !ok {
+			return errors.New("规则 " + name + " 的 level 只能是 passive、active、timeSensitive 或 critical")
+		}
+		if len(rule.Forward) > 10 {
+			return errors.New("规则 " + name + " 最多转发给 10 个目标")
+		}
+	}
+	return nil
+}
+
+// 改写时可以用 $1、${name} 引用对应条件中正则的分组
+func rewrite(re *regexp.Regexp, value string, replacement string) string {
+	if re == nil {
+		return replacement
+	}
+	result := []byte{}
+	for _, match := range re.FindAllStringSubmatchIndex(value, 1) {
+		result = re.ExpandString(result, replacement, value, match)
+	}
+	return string(result)
+}
+
+// 依次执行规则，返回执行后的消息；不修改传入的 msg
+func applyRules(rules []routeRule, msg *Message) *ruleResult {
+	copied := *msg
+	copied.Params = map[string]interface{}{}
+	for name, value := range msg.Params {
+		copied.Params[name] = value
+	}
+	result := &ruleResult{Message: &copied, Matched: []string{}, Forward: []string{}}
+
+	for i, rule := range rules {
+		msg := result.Message
+		group, _ := msg.Params["group"].(string)
+		if len(rule.Category) > 0 && rule.Category != msg.Category {
+			continue
+		}
+		titleRe, _ := compileRule(rule.Title)
+		bodyRe, _ := compileRule(rule.Body)
+		groupRe, _ := compileRule(rule.Group)
+		if (titleRe != nil && !titleRe.MatchString(msg.Title)) ||
+			(bodyRe != nil && !bodyRe.MatchString(msg.Body)) ||
+			(groupRe != nil && !groupRe.MatchString(group)) {
+			continue
+		}
+
+		name := rule.Name
+		if len(name) == 0 {
+			name = "#" + strconv.Itoa(i+1)
+		}
+		result.Matched = append(result.Matched, name)
+		if rule.SetTitle != nil {
+			msg.Title = rewrite(titleRe, msg.Title, *rule.SetTitle)
+		}
+		if rule.SetBody != nil {
+			msg.Body = rewrite(bodyRe, msg.Body, *rule.SetBody)
+		}
+		if len(rule.Sound) > 0 {
+			msg.Params["sound"] = rule.Sound
+		}
+		if len(rule.Level) > 0 {
+			msg.Params["level"] = rule.Level
+		}
+		if len(rule.SetGroup) > 0 {
+			msg.Params["group"] = rule.SetGroup
+		}
+		result.Forward = append(result.Forward, rule.Forward...)
+		if rule.Drop {
+			result.Drop = true
+		}
+		if rule.Drop || rule.Stop {
+			break
+		}
+	}
+	return result
+}
+
+// 在 pushToKey 中最先调用：执行 key 的路由规则并转发匹配的推送，返回 false 时推送被丢弃
+func routeMessage(ctx context.Context, key string, msg *Message) (*Message, bool) {
+	meta, err := getKeyMeta(key)
+	if err != nil || len(meta.Rules) == 0 {
+		return msg, true
+	}
+	logger := slog.Default().With(secret("key", redactKey, key))
+	result := applyRules(meta.Rules, msg)
+	if len(result.Matched) == 0 {
+		return msg, true
+	}
+	logger.Debug("推送匹配了路由规则", "rules", result.Matched, "drop", result.Drop)
+
+	chain, _ := ctx.Value(forwardChainKey{}).([]string)
+	if len(result.Forward) > 0 && len(chain) < maxForwardDepth {
+		chain = append(append([]string{}, chain...), key)
+		forwardCtx := context.WithValue(ctx, forwardChainKey{}, chain)
+		// 转发给每个目标同样要经过限流和每日配额，来源 IP 沿用原始推送的
+		targets := []string{}
+		for _, target := range result.Forward {
+			for _, k := range getTopicKeys(target) {
+				if k == key || contains(chain, k) || contains(targets, k) {
+					continue
+				}
+				targets = append(targets, k)
+			}
+		}
+		if len(targets) > 0 {
+			if err := pushToKeys(forwardCtx, targets, contextClientIP(ctx), result.Message); err != nil {
+				logger.Warn("转发推送失败", "err", err)
+			}
+		}
+	} else if len(result.Forward) > 0 {
+		logger.Warn("转发层数过多，不再转发", "depth", len(chain))
+	}
+	if result.Drop {
+		logger.Info("推送被路由规则丢弃", "rules", result.Matched)
+		return nil, false
+	}
+	return result.Message, true
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// GET 查看、POST/PUT 用 JSON 数组替换、DELETE 清空 key 的路由规则
+func rulesHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	key := bone.GetValue(r, "key")
+	if !keyExists(key) {
+		fmt.Fprint(w, responseString(400, "找不到key对应的DeviceToken, 请确保Key正确! Key可在App端注册获得。"))
+		return
+	}
+
+	var meta *KeyMeta
+	var err error
+	switch r.Method {
+	case "POST", "PUT":
+		var rules []routeRule
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&rules); err != nil {
+			fmt.Fprint(w, responseString(400, "规则应为 JSON 数组"))
+			return
+		}
+		if err := validateRules(rules); err != nil {
+			fmt.Fprint(w, responseString(400, err.Error()))
+			return
+		}
+		meta, err = updateKeyMeta(key, func(meta *KeyMeta) error {
+			meta.Rules = rules
+			return nil
+		})
+	case "DELETE":
+		meta, err = updateKeyMeta(key, func(meta *KeyMeta) error {
+			meta.Rules = nil
+			return nil
+		})
+	default:
+		meta, err = getKeyMeta(key)
+	}
+	if err != nil {
+		fmt.Fprint(w, responseString(500, err.Error()))
+		return
+	}
+	rules := meta.Rules
+	if rules == nil {
+		rules = []routeRule{}
+	}
+	fmt.Fprint(w, responseData(200, rules, ""))
+}
+
+// 用示例消息测试规则，不推送。JSON {"message": {...}, "rules": [...]}，不带 rules 时使用已保存的规则；
+// 也可以用 category、title、body、group 表单参数给出示例消息
+func testRules(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	key := bone.GetValue(r, "key")
+	if !keyExists(key) {
+		fmt.Fprint(w, responseString(400, "找不到key对应的DeviceToken, 请确保Key正确! Key可在App端注册获得。"))
+		return
+	}
+
+	req := struct {
+		Message *Message     `json:"message"`
+		Rules   *[]routeRule `json:"rules"`
+	}{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+			fmt.Fprint(w, responseString(400, "JSON 格式不正确"))
+			return
+		}
+	}
+	if req.Message == nil {
+		req.Message = &Message{
+			Category: r.FormValue("category"),
+			Title:    r.FormValue("title"),
+			Body:     r.FormValue("body"),
+			Params:   map[string]interface{}{},
+		}
+		if group := r.FormValue("group"); len(group) > 0 {
+			req.Message.Params["group"] = group
+		}
+	}
+
+	var rules []routeRule
+	if req.Rules != nil {
+		rules = *req.Rules
+		if err := validateRules(rules); err != nil {
+			fmt.Fprint(w, responseString(400, err.Error()))
+			return
+		}
+	} else {
+		meta, err := getKeyMeta(key)
+		if err != nil {
+			fmt.Fprint(w, responseString(500, err.Error()))
+			return
+		}
+		rules = meta.Rules
+	}
+	fmt.Fprint(w, responseData(200, applyRules(rules, req.Message), "测试，未发送"))
+}
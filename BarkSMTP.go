@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// 内嵌的 SMTP 服务，把发给 <key>@<domain> 的邮件转成推送，给只能发邮件报警的 NAS、UPS、打印机等设备使用。
+// 收件人不是 key 时，也可以把 key 写在标题中，例如 [key] 或者 key: 开头
+type smtpConfig struct {
+	Addr    string
+	Domain  string   // 只接收发往这个域名的邮件，为空时不检查
+	Allow   []string // 允许的发件人，完整地址或者 @域名，为空时不限制
+	MaxSize int
+}
+
+type smtpBackend struct {
+	config smtpConfig
+}
+
+type smtpSession struct {
+	backend *smtpBackend
+	ip      string
+	from    string
+	keys    []string
+}
+
+// 推送内容最多保留的字符数
+const smtpMaxBody = 3000
+
+var smtpSubjectKey = regexp.MustCompile(`[A-Za-z0-9_-]{8,}`)
+
+var htmlDropped = regexp.MustCompile(`(?is)<(script|style|head)[^>]*>.*?</(script|style|head)>`)
+var htmlBreaks = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|tr|li|h[1-6])>`)
+var htmlTags = regexp.MustCompile(`<[^>]*>`)
+var blankLines = regexp.MustCompile(`\n[ \t]*(\n[ \t]*)+`)
+
+func (b *smtpBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	return nil, smtp.ErrAuthUnsupported
+}
+
+func (b *smtpBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	ip := state.RemoteAddr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return &smtpSession{backend: b, ip: ip}, nil
+}
+
+func smtpReject(code int, enhanced smtp.EnhancedCode, message string) *smtp.SMTPError {
+	return &smtp.SMTPError{Code: code, EnhancedCode: enhanced, Message: message}
+}
+
+func (b *smtpBackend) allowed(from string) bool {
+	if len(b.config.Allow) == 0 {
+		return true
+	}
+	from = strings.ToLower(from)
+	for _, allow := range b.config.Allow {
+		allow = strings.ToLower(allow)
+		if from == allow || (strings.HasPrefix(allow, "@") && strings.HasSuffix(from, allow)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *smtpSession) Reset() {
+	s.from = ""
+	s.keys = nil
+}
+
+func (s *smtpSession) Logout() error {
+	return nil
+}
+
+func (s *smtpSession) Mail(from string, opts smtp.MailOptions) error {
+	if !s.backend.allowed(from) {
+		slog.Warn("拒绝不在白名单中的发件人", "from", from, "ip", s.ip)
+		return smtpReject(550, smtp.EnhancedCode{5, 7, 1}, "Sender not allowed")
+	}
+	s.from = from
+	return nil
+}
+
+// 收件人的用户名是 key 或者 ntfy topic 时直接记下，否则等读到标题后再找 key
+func (s *smtpSession) Rcpt(to string) error {
+	local, domain, ok := strings.Cut(to, "@")
+	if !ok {
+		return smtpReject(550, smtp.EnhancedCode{5, 1, 3}, "Bad recipient address")
+	}
+	if len(s.backend.config.Domain) > 0 && !strings.EqualFold(domain, s.backend.config.Domain) {
+		return smtpReject(550, smtp.EnhancedCode{5, 7, 1}, "Relay not permitted")
+	}
+	s.keys = append(s.keys, getTopicKeys(local)...)
+	return nil
+}
+
+func (s *smtpSession) Data(r io.Reader) error {
+	logger := slog.Default().With("from", s.from, "ip", s.ip)
+	m, err := mail.ReadMessage(r)
+	if err != nil {
+		return smtpReject(554, smtp.EnhancedCode{5, 6, 0}, "Malformed message")
+	}
+
+	decoder := &mime.WordDecoder{}
+	subject, err := decoder.DecodeHeader(m.Header.Get("Subject"))
+	if err != nil {
+		subject = m.Header.Get("Subject")
+	}
+	keys := s.keys
+	if len(keys) == 0 {
+		subject, keys = subjectKeys(subject)
+	}
+	if len(keys) == 0 {
+		logger.Info("邮件中找不到key", secret("subject", redactBody, subject))
+		return smtpReject(550, smtp.EnhancedCode{5, 1, 1}, "No such key")
+	}
+
+	body, err := mailText(m.Header.Get("Content-Type"), m.Header.Get("Content-Transfer-Encoding"), m.Body, 0)
+	if err != nil {
+		logger.Warn("解析邮件失败", "err", err)
+		return smtpReject(554, smtp.EnhancedCode{5, 6, 0}, "Cannot parse message")
+	}
+	body = strings.TrimSpace(body)
+	if len(body) == 0 {
+		body = "无推送文字内容"
+	}
+
+	params := map[string]interface{}{}
+	if address, err := mail.ParseAddress(s.from); err == nil {
+		params["group"] = address.Address
+	} else if len(s.from) > 0 {
+		params["group"] = s.from
+	}
+	msg := &Message{Title: strings.TrimSpace(subject), Body: truncate(body, smtpMaxBody), Params: params}
+	logger.Debug("收到邮件", secret("title", redactBody, msg.Title), secret("body", redactBody, msg.Body), "keys", len(keys))
+
+	if err := pushToKeys(context.Background(), keys, s.ip, msg); err != nil {
+		var limited *limitError
+		if errors.As(err, &limited) {
+			return smtpReject(451, smtp.EnhancedCode{4, 7, 0}, "Rate limited, try again later")
+		}
+		logger.Warn("邮件推送失败", "err", err)
+		return smtpReject(451, smtp.EnhancedCode{4, 3, 0}, "Push failed")
+	}
+	logger.Info("邮件推送成功", "keys", len(keys))
+	return nil
+}
+
+// 从标题中找出 key，并把它从标题中去掉，例如 "[key] UPS 断电" 或 "key: UPS 断电"
+func subjectKeys(subject string) (string, []string) {
+	for _, word := range smtpSubjectKey.FindAllString(subject, -1) {
+		keys := getTopicKeys(word)
+		if len(keys) == 0 {
+			continue
+		}
+		for _, pattern := range []string{"[" + word + "]", word + ":", word} {
+			if strings.Contains(subject, pattern) {
+				subject = strings.Replace(subject, pattern, "", 1)
+				break
+			}
+		}
+		return strings.TrimSpace(subject), keys
+	}
+	return subject, nil
+}
+
+// 取出邮件的正文：优先 text/plain，只有 HTML 时去掉标签，附件忽略
+func mailText(contentType string, encoding string, body io.Reader, depth int) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || len(contentType) == 0 {
+		mediaType = "text/plain"
+	}
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, newlineSkipper{body})
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth > 5 {
+			return "", nil
+		}
+		reader := multipart.NewReader(body, params["boundary"])
+		var plain, htmlText string
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+			if disposition, _, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition")); disposition == "attachment" {
+				continue
+			}
+			partType := part.Header.Get("Content-Type")
+			// multipart.Part 会自动解码 quoted-printable 并删除这个头
+			text, err := mailText(partType, part.Header.Get("Content-Transfer-Encoding"), part, depth+1)
+			if err != nil {
+				return "", err
+			}
+			if strings.HasPrefix(strings.ToLower(partType), "text/html") {
+				if len(htmlText) == 0 {
+					htmlText = text
+				}
+			} else if len(plain) == 0 {
+				plain = text
+			}
+		}
+		if len(strings.TrimSpace(plain)) > 0 {
+			return plain, nil
+		}
+		return htmlText, nil
+	}
+
+	if !strings.HasPrefix(mediaType, "text/") {
+		return "", nil
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	if mediaType == "text/html" {
+		text = stripHTML(text)
+	}
+	return text, nil
+}
+
+func stripHTML(s string) string {
+	s = htmlDropped.ReplaceAllString(s, "")
+	s = htmlBreaks.ReplaceAllString(s, "\n")
+	s = htmlTags.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	return blankLines.ReplaceAllString(s, "\n\n")
+}
+
+// base64 正文按行折断，解码前去掉换行
+type newlineSkipper struct {
+	r io.Reader
+}
+
+func (n newlineSkipper) Read(p []byte) (int, error) {
+	count, err := n.r.Read(p)
+	return copy(p, bytes.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, p[:count])), err
+}
+
+type smtpLogger struct{}
+
+func (smtpLogger) Printf(format string, v ...interface{}) {
+	slog.Warn("SMTP 服务出错", "err", fmt.Sprintf(format, v...))
+}
+
+func (smtpLogger) Println(v ...interface{}) {
+	slog.Warn("SMTP 服务出错", "err", strings.TrimSpace(fmt.Sprintln(v...)))
+}
+
+func startSMTP(config smtpConfig) error {
+	server := smtp.NewServer(&smtpBackend{config: config})
+	server.Addr = config.Addr
+	server.Domain = config.Domain
+	if len(server.Domain) == 0 {
+		server.Domain = "localhost"
+	}
+	server.MaxMessageBytes = config.MaxSize
+	server.MaxRecipients = 20
+	server.ReadTimeout = time.Minute
+	server.WriteTimeout = time.Minute
+	server.AuthDisabled = true
+	server.ErrorLog = smtpLogger{}
+
+	listener, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		return err
+	}
+	go server.Serve(listener)
+	onShutdown(func(ctx context.Context) {
+		server.Close()
+	})
+	slog.Info("SMTP 服务已启动", "addr", listener.Addr().String(), "domain", config.Domain)
+	return nil
+}
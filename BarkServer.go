@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var shuttingDown int32
+
+var shutdownMu sync.Mutex
+var shutdownHooks []func(ctx context.Context)
+var reloadHooks []func() error
+
+// 注册退出时需要执行的清理，在 HTTP 请求处理完之后、关闭数据库之前按注册顺序执行
+func onShutdown(fn func(ctx context.Context)) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	shutdownHooks = append(shutdownHooks, fn)
+}
+
+// 注册收到 SIGHUP 时需要重新加载的内容，例如证书
+func onReload(name string, fn func() error) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	reloadHooks = append(reloadHooks, func() error {
+		if err := fn(); err != nil {
+			slog.Error("重新加载失败，继续使用旧配置", "name", name, "err", err)
+			return err
+		}
+		slog.Info("重新加载成功", "name", name)
+		return nil
+	})
+}
+
+func reload() {
+	shutdownMu.Lock()
+	hooks := reloadHooks
+	shutdownMu.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+}
+
+// 在所有监听上启动 HTTP 服务，srv.TLSConfig 不为空时使用 TLS。
+// 收到 SIGHUP 重新加载证书；收到 SIGINT/SIGTERM 后 /readyz 先返回 503，drainDelay 之后停止接收新请求，
+// 等待进行中的请求处理完毕，再用新的超时执行退出清理，最后关闭数据库
+func serve(srv *http.Server, listeners []net.Listener, drainDelay time.Duration, shutdownTimeout time.Duration) {
+	errCh := make(chan error, len(listeners))
+	for _, l := range listeners {
+		slog.Info("Serving HTTP on "+l.Addr().String(), "tls", srv.TLSConfig != nil)
+		go func(l net.Listener) {
+			if srv.TLSConfig != nil {
+				errCh <- srv.ServeTLS(l, "", "")
+			} else {
+				errCh <- srv.Serve(l)
+			}
+		}(l)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+wait:
+	for {
+		select {
+		case err := <-errCh:
+			fatal("HTTP服务退出", "err", err)
+		case s := <-sig:
+			if s == syscall.SIGHUP {
+				reload()
+				continue
+			}
+			slog.Info("收到退出信号，开始关闭", "signal", s.String())
+			break wait
+		}
+	}
+	atomic.StoreInt32(&shuttingDown, 1)
+	// 给负载均衡留出发现 /readyz 返回 503 的时间
+	if drainDelay > 0 {
+		slog.Info("等待负载均衡摘除流量", "delay", drainDelay)
+		time.Sleep(drainDelay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("等待请求结束超时", "err", err)
+	}
+
+	// 请求可能已经用完了超时，清理使用单独的超时
+	hookCtx, hookCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer hookCancel()
+	shutdownMu.Lock()
+	hooks := shutdownHooks
+	shutdownMu.Unlock()
+	for _, hook := range hooks {
+		hook(hookCtx)
+	}
+
+	if err := boltDB.Close(); err != nil {
+		slog.Error("关闭数据库失败", "err", err)
+	}
+	slog.Info("已退出")
+}
+
+func checkDB() error {
+	return boltDB.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("device")) == nil {
+			return errors.New("device bucket 不存在")
+		}
+		return nil
+	})
+}
+
+func checkCertificate() error {
+	cert := currentCert()
+	if cert == nil {
+		return errors.New("推送证书未加载")
+	}
+	now := time.Now()
+	if now.After(cert.NotAfter) {
+		return errors.New("推送证书已于 " + cert.NotAfter.Format("2006-01-02 15:04:05") + " 过期")
+	}
+	if now.Before(cert.NotBefore) {
+		return errors.New("推送证书尚未生效")
+	}
+	return nil
+}
+
+func writeHealth(w http.ResponseWriter, checks map[string]error) {
+	data := make(map[string]interface{})
+	if cert := currentCert(); cert != nil {
+		data["certificate_expires_at"] = cert.NotAfter
+		data["certificate_days_left"] = certDaysLeft(cert)
+	}
+	healthy := true
+	for name, err := range checks {
+		if err != nil {
+			healthy = false
+			data[name] = err.Error()
+		} else {
+			data[name] = "ok"
+		}
+	}
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, responseData(503, data, "unhealthy"))
+		return
+	}
+	fmt.Fprint(w, responseData(200, data, "ok"))
+}
+
+// 存活检查，只要数据库可读就认为进程正常
+func healthz(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	writeHealth(w, map[string]error{"db": checkDB()})
+}
+
+// 就绪检查，关闭过程中或推送证书不可用时返回 503，让负载均衡摘掉流量
+func readyz(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	checks := map[string]error{
+		"db":          checkDB(),
+		"certificate": checkCertificate(),
+	}
+	if atomic.LoadInt32(&shuttingDown) == 1 {
+		checks["server"] = errors.New("正在关闭")
+	}
+	writeHealth(w, checks)
+}
+
+func parseLeaf(der [][]byte) (*x509.Certificate, error) {
+	if len(der) == 0 {
+		return nil, errors.New("证书为空")
+	}
+	return x509.ParseCertificate(der[0])
+}
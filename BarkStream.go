@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-zoo/bone"
+	"github.com/gorilla/websocket"
+)
+
+// 保存在 history bucket 中的一条消息，序号作为 SSE 的 event id
+type streamEvent struct {
+	ID      uint64     `json:"id"`
+	Time    time.Time  `json:"time"`
+	Message *Message   `json:"message"`
+	Status  pushStatus `json:"status,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+var HistoryLimit int = 100
+
+// 每个 key 当前连接的订阅者
+type streamHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan *streamEvent]bool
+	// 关闭服务时关闭，让所有长连接退出，否则 http.Server.Shutdown 会一直等到超时
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+var hub = &streamHub{subs: make(map[string]map[chan *streamEvent]bool), closing: make(chan struct{})}
+
+// 通过 http.Server.RegisterOnShutdown 在开始关闭时调用
+func closeStreams() {
+	hub.closeOnce.Do(func() { close(hub.closing) })
+}
+
+func (h *streamHub) subscribe(key string) chan *streamEvent {
+	ch := make(chan *streamEvent, 64)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[key] == nil {
+		h.subs[key] = make(map[chan *streamEvent]bool)
+	}
+	h.subs[key][ch] = true
+	return ch
+}
+
+func (h *streamHub) unsubscribe(key string, ch chan *streamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs[key], ch)
+	if len(h.subs[key]) == 0 {
+		delete(h.subs, key)
+	}
+}
+
+// 订阅者处理不过来时丢弃，断线重连后可以通过 Last-Event-ID 从历史中补回
+func (h *streamHub) publish(key string, event *streamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[key] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// 每条推送都写入历史并发给在线的订阅者。被合并或暂存的推送稍后发送时还会再回调一次，
+// 这里只记录最终发出的那一条；发送失败的也记录下来，带上状态和错误
+func recordHistory(key string, msg *Message, status pushStatus, err error) {
+	if status != pushSent && status != pushFailed {
+		return
+	}
+	event := &streamEvent{Time: time.Now(), Message: msg, Status: status}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	seq, e := appendRecord("history", key, event, HistoryLimit)
+	if e != nil {
+		slog.Error("保存推送历史失败", secret("key", redactKey, key), "err", e)
+		return
+	}
+	event.ID = seq
+	hub.publish(key, event)
+}
+
+// 读取 after 之后的历史
+func historyAfter(key string, after uint64) ([]*streamEvent, error) {
+	var events []*streamEvent
+	err := listRecords("history", key, after, 0, func(seq uint64, val []byte) error {
+		event := &streamEvent{}
+		if err := json.Unmarshal(val, event); err != nil {
+			return err
+		}
+		event.ID = seq
+		events = append(events, event)
+		return nil
+	})
+	return events, err
+}
+
+// 没有带 Last-Event-ID 的新连接只接收之后的消息，last_event_id=0 可以取回全部历史
+func lastEventID(r *http.Request) (uint64, bool) {
+	id := r.Header.Get("Last-Event-ID")
+	if len(id) == 0 {
+		id = r.URL.Query().Get("last_event_id")
+	}
+	seq, err := strconv.ParseUint(id, 10, 64)
+	return seq, err == nil
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	// key 本身就是凭证，不限制来源
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// GET /:key/stream，普通请求使用 SSE，带 Upgrade: websocket 时使用 WebSocket
+func stream(w http.ResponseWriter, r *http.Request) {
+	key := bone.GetValue(r, "key")
+	if !keyExists(key) {
+		fmt.Fprint(w, responseString(400, "找不到key对应的DeviceToken, 请确保Key正确! Key可在App端注册获得。"))
+		return
+	}
+
+	// 先订阅再读历史，避免两者之间的消息丢失
+	ch := hub.subscribe(key)
+	defer hub.unsubscribe(key, ch)
+	after, resume := lastEventID(r)
+	var missed []*streamEvent
+	if resume {
+		var err error
+		missed, err = historyAfter(key, after)
+		if err != nil {
+			fmt.Fprint(w, responseString(500, err.Error()))
+			return
+		}
+	}
+
+	logger := requestLogger(r).With(secret("key", redactKey, key))
+	if websocket.IsWebSocketUpgrade(r) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			logger.Info("WebSocket握手失败", "err", err)
+			return
+		}
+		defer conn.Close()
+		logger.Info("WebSocket订阅已连接")
+		streamWebSocket(conn, ch, missed, after)
+		logger.Info("WebSocket订阅已断开")
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	// 长连接不受服务器的写超时限制
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 5000\n\n")
+	logger.Info("SSE订阅已连接")
+
+	write := func(event *streamEvent) error {
+		data, _ := json.Marshal(event)
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", event.ID, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	for _, event := range missed {
+		if write(event) != nil {
+			return
+		}
+		after = event.ID
+	}
+	rc.Flush()
+
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			logger.Info("SSE订阅已断开")
+			return
+		case <-hub.closing:
+			logger.Info("服务关闭，断开SSE订阅")
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			rc.Flush()
+		case event := <-ch:
+			if event.ID <= after {
+				continue
+			}
+			if write(event) != nil {
+				return
+			}
+			after = event.ID
+		}
+	}
+}
+
+func streamWebSocket(conn *websocket.Conn, ch chan *streamEvent, missed []*streamEvent, after uint64) {
+	// 读取客户端消息只是为了处理 ping/pong 和关闭
+	closed := make(chan struct{})
+	conn.SetReadLimit(1024)
+	conn.SetReadDeadline(time.Now().Add(90 * time.Second))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(90 * time.Second))
+		return nil
+	})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(event *streamEvent) error {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return conn.WriteJSON(event)
+	}
+	for _, event := range missed {
+		if write(event) != nil {
+			return
+		}
+		after = event.ID
+	}
+
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-hub.closing:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(time.Second))
+			return
+		case <-heartbeat.C:
+			if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)) != nil {
+				return
+			}
+		case event := <-ch:
+			if event.ID <= after {
+				continue
+			}
+			if write(event) != nil {
+				return
+			}
+			after = event.ID
+		}
+	}
+}
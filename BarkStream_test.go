@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// 合并和暂存的推送稍后发送时才记录，避免同一条推送在历史中出现两次
+func TestRecordHistoryStatus(t *testing.T) {
+	openTestDB(t)
+	key := "streamTestKey1"
+	recordHistory(key, &Message{Body: "digested"}, pushDigested, nil)
+	recordHistory(key, &Message{Body: "held"}, pushHeld, nil)
+	recordHistory(key, &Message{Body: "sent"}, pushSent, nil)
+	recordHistory(key, &Message{Body: "failed"}, pushFailed, errors.New("推送发送失败 HTTP 500"))
+
+	events, err := historyAfter(key, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		body   string
+		status pushStatus
+		err    string
+	}{
+		{"sent", pushSent, ""},
+		{"failed", pushFailed, "推送发送失败 HTTP 500"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("history has %d events, want %d", len(events), len(want))
+	}
+	for i, w := range want {
+		e := events[i]
+		if e.Message.Body != w.body || e.Status != w.status || e.Error != w.err {
+			t.Errorf("event %d = %s %s %q, want %s %s %q", i, e.Message.Body, e.Status, e.Error, w.body, w.status, w.err)
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/go-zoo/bone"
+)
+
+// 保存在 template bucket 中每个 key 的子 bucket 里，各字段都是 text/template
+type messageTemplate struct {
+	Name      string            `json:"name"`
+	Title     string            `json:"title"`
+	Body      string            `json:"body"`
+	Category  string            `json:"category,omitempty"`
+	Sound     string            `json:"sound,omitempty"`
+	Params    map[string]string `json:"params,omitempty"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+var templateNamePattern = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)
+
+const templateMaxPerKey = 50
+const templateMaxSize = 4096
+
+// 渲染结果的限制：渲染过程中每个字段最多输出的字节数，超过时渲染失败；
+// 渲染后 body 最多保留的字符数，其它字段最多保留的字符数
+const (
+	templateMaxOutput = 1 << 16
+	templateMaxBody   = 3000
+	templateMaxField  = 512
+)
+
+// 超过上限后拒绝继续写入，避免模板中的循环生成过大的内容
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.limit {
+		return 0, errors.New("渲染结果超过 " + strconv.Itoa(b.limit) + " 字节")
+	}
+	return b.Buffer.Write(p)
+}
+
+var templateFuncs = template.FuncMap{
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"trim":  strings.TrimSpace,
+	"default": func(def interface{}, value interface{}) interface{} {
+		if value == nil || value == "" {
+			return def
+		}
+		return value
+	},
+	"truncate": func(n int, s string) string {
+		return truncate(s, n)
+	},
+}
+
+// 模板的各个字段，自定义字段以 params. 为前缀
+func (t *messageTemplate) fields() map[string]string {
+	fields := map[string]string{"title": t.Title, "body": t.Body, "category": t.Category, "sound": t.Sound}
+	for name, value := range t.Params {
+		fields["params."+name] = value
+	}
+	return fields
+}
+
+func (t *messageTemplate) validate() error {
+	if !templateNamePattern.MatchString(t.Name) {
+		return errors.New("模板名只能包含字母、数字、- 和 _")
+	}
+	if len(t.Body) == 0 {
+		return errors.New("模板的 body 不能为空")
+	}
+	size := 0
+	for name, value := range t.fields() {
+		size += len(value)
+		if _, err := template.New(name).Funcs(templateFuncs).Parse(value); err != nil {
+			return err
+		}
+	}
+	if size > templateMaxSize {
+		return errors.New("模板不能超过 " + strconv.Itoa(templateMaxSize) + " 字节")
+	}
+	return nil
+}
+
+// 依次渲染各个字段，缺少变量时报错，便于在预览时发现；渲染结果过长时截断
+func (t *messageTemplate) render(vars map[string]interface{}) (*Message, error) {
+	rendered := map[string]string{}
+	for name, value := range t.fields() {
+		tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(value)
+		if err != nil {
+			return nil, err
+		}
+		buf := &limitedBuffer{limit: templateMaxOutput}
+		if err := tmpl.Execute(buf, vars); err != nil {
+			return nil, err
+		}
+		if name == "body" {
+			rendered[name] = truncate(buf.String(), templateMaxBody)
+		} else {
+			rendered[name] = truncate(buf.String(), templateMaxField)
+		}
+	}
+
+	msg := &Message{Category: rendered["category"], Title: rendered["title"], Body: rendered["body"], Params: map[string]interface{}{}}
+	if len(rendered["sound"]) > 0 {
+		msg.Params["sound"] = rendered["sound"]
+	}
+	for name := range t.Params {
+		msg.Params[name] = rendered["params."+name]
+	}
+	return msg, nil
+}
+
+func getTemplate(key string, name string) (*messageTemplate, error) {
+	var t *messageTemplate
+	err := boltDB.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte("template"))
+		if root == nil {
+			return nil
+		}
+		bucket := root.Bucket([]byte(key))
+		if bucket == nil {
+			return nil
+		}
+		if val := bucket.Get([]byte(name)); val != nil {
+			t = &messageTemplate{}
+			return json.Unmarshal(val, t)
+		}
+		return nil
+	})
+	return t, err
+}
+
+func listTemplates(key string) ([]*messageTemplate, error) {
+	templates := []*messageTemplate{}
+	err := boltDB.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte("template"))
+		if root == nil {
+			return nil
+		}
+		bucket := root.Bucket([]byte(key))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			t := &messageTemplate{}
+			if err := json.Unmarshal(v, t); err != nil {
+				return err
+			}
+			templates = append(templates, t)
+			return nil
+		})
+	})
+	return templates, err
+}
+
+var errTooManyTemplates = errors.New("每个key最多保存 " + strconv.Itoa(templateMaxPerKey) + " 个模板")
+
+func saveTemplate(key string, t *messageTemplate) error {
+	val, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return boltDB.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists([]byte("template"))
+		if err != nil {
+			return err
+		}
+		bucket, err := root.CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return err
+		}
+		if bucket.Get([]byte(t.Name)) == nil {
+			count := 0
+			bucket.ForEach(func(k, v []byte) error {
+				count++
+				return nil
+			})
+			if count >= templateMaxPerKey {
+				return errTooManyTemplates
+			}
+		}
+		return bucket.Put([]byte(t.Name), val)
+	})
+}
+
+func deleteTemplate(key string, name string) (bool, error) {
+	found := false
+	err := boltDB.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte("template"))
+		if root == nil {
+			return nil
+		}
+		bucket := root.Bucket([]byte(key))
+		if bucket == nil || bucket.Get([]byte(name)) == nil {
+			return nil
+		}
+		found = true
+		return bucket.Delete([]byte(name))
+	})
+	return found, err
+}
+
+// JSON 请求体为 {"vars": {...}}，预览时还可以带上未保存的 "template"；
+// 其它请求把表单和 URL 参数作为字符串变量
+type templateRequest struct {
+	Vars     map[string]interface{} `json:"vars"`
+	Template *messageTemplate       `json:"template"`
+}
+
+func readTemplateRequest(r *http.Request) (*templateRequest, error) {
+	req := &templateRequest{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(req); err != nil {
+			return nil, errors.New("JSON 格式不正确")
+		}
+	} else {
+		r.ParseForm()
+		req.Vars = map[string]interface{}{}
+		for name, values := range r.Form {
+			if name != "dry_run" {
+				req.Vars[name] = values[0]
+			}
+		}
+	}
+	if req.Vars == nil {
+		req.Vars = map[string]interface{}{}
+	}
+	return req, nil
+}
+
+// 新建或修改模板时，JSON 请求体为模板本身，表单只支持 title、body、category、sound 和 JSON 格式的 params
+func readTemplate(r *http.Request, name string) (*messageTemplate, error) {
+	t := &messageTemplate{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(t); err != nil {
+			return nil, errors.New("JSON 格式不正确")
+		}
+	} else {
+		r.ParseForm()
+		t.Title = r.FormValue("title")
+		t.Body = r.FormValue("body")
+		t.Category = r.FormValue("category")
+		t.Sound = r.FormValue("sound")
+		if params := r.FormValue("params"); len(params) > 0 {
+			if err := json.Unmarshal([]byte(params), &t.Params); err != nil {
+				return nil, errors.New("params 必须是 JSON 对象")
+			}
+		}
+	}
+	t.Name = name
+	t.UpdatedAt = time.Now()
+	return t, t.validate()
+}
+
+// GET /template/:key 列出 key 的所有模板
+func templates(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	key := bone.GetValue(r, "key")
+	if !keyExists(key) {
+		fmt.Fprint(w, responseString(400, "找不到key对应的DeviceToken, 请确保Key正确! Key可在App端注册获得。"))
+		return
+	}
+	list, err := listTemplates(key)
+	if err != nil {
+		fmt.Fprint(w, responseString(500, err.Error()))
+		return
+	}
+	fmt.Fprint(w, responseData(200, list, ""))
+}
+
+// GET 查看、POST/PUT 保存、DELETE 删除 /template/:key/:name
+func templateHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	key := bone.GetValue(r, "key")
+	name := bone.GetValue(r, "name")
+	if !keyExists(key) {
+		fmt.Fprint(w, responseString(400, "找不到key对应的DeviceToken, 请确保Key正确! Key可在App端注册获得。"))
+		return
+	}
+
+	switch r.Method {
+	case "POST", "PUT":
+		t, err := readTemplate(r, name)
+		if err != nil {
+			fmt.Fprint(w, responseString(400, "模板不正确: "+err.Error()))
+			return
+		}
+		if err := saveTemplate(key, t); err != nil {
+			code := 500
+			if err == errTooManyTemplates {
+				code = 400
+			}
+			fmt.Fprint(w, responseString(code, err.Error()))
+			return
+		}
+		fmt.Fprint(w, responseData(200, t, "保存成功"))
+	case "DELETE":
+		found, err := deleteTemplate(key, name)
+		if err != nil {
+			fmt.Fprint(w, responseString(500, err.Error()))
+			return
+		}
+		if !found {
+			fmt.Fprint(w, responseString(400, "找不到模板 "+name))
+			return
+		}
+		fmt.Fprint(w, responseString(200, "删除成功"))
+	default:
+		t, err := getTemplate(key, name)
+		if err != nil {
+			fmt.Fprint(w, responseString(500, err.Error()))
+			return
+		}
+		if t == nil {
+			fmt.Fprint(w, responseString(400, "找不到模板 "+name))
+			return
+		}
+		fmt.Fprint(w, responseData(200, t, ""))
+	}
+}
+
+// 读取请求中的变量并渲染模板，preview 为 true 时可以使用请求中未保存的模板
+func renderTemplateRequest(r *http.Request, key string, name string, preview bool) (*Message, error) {
+	req, err := readTemplateRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	t := req.Template
+	if t != nil && preview {
+		t.Name = name
+		if err := t.validate(); err != nil {
+			return nil, errors.New("模板不正确: " + err.Error())
+		}
+	} else {
+		t, err = getTemplate(key, name)
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			return nil, errors.New("找不到模板 " + name)
+		}
+	}
+	msg, err := t.render(req.Vars)
+	if err != nil {
+		return nil, errors.New("模板渲染失败: " + err.Error())
+	}
+	return msg, nil
+}
+
+// POST /template/:key/:name/preview 只渲染不推送
+func templatePreview(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	key := bone.GetValue(r, "key")
+	name := bone.GetValue(r, "name")
+	if !keyExists(key) {
+		fmt.Fprint(w, responseString(400, "找不到key对应的DeviceToken, 请确保Key正确! Key可在App端注册获得。"))
+		return
+	}
+	msg, err := renderTemplateRequest(r, key, name, true)
+	if err != nil {
+		fmt.Fprint(w, responseString(400, err.Error()))
+		return
+	}
+	fmt.Fprint(w, responseData(200, msg, ""))
+}
+
+// GET/POST /template/:key/:name/push 使用模板推送
+func templatePush(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	key := bone.GetValue(r, "key")
+	name := bone.GetValue(r, "name")
+	logger := requestLogger(r).With(secret("key", redactKey, key), "template", name)
+	if !keyExists(key) {
+		fmt.Fprint(w, responseString(400, "找不到key对应的DeviceToken, 请确保Key正确! Key可在App端注册获得。"))
+		return
+	}
+	// 先渲染再限流，渲染失败的请求不占用配额
+	msg, err := renderTemplateRequest(r, key, name, false)
+	if err != nil {
+		logger.Info("模板渲染失败", "err", err)
+		fmt.Fprint(w, responseString(400, err.Error()))
+		return
+	}
+	if isDryRun(r) {
+		writePreview(w, key, msg)
+		return
+	}
+	if e := checkLimit(key, clientIP(r)); e != nil {
+		logger.Warn("推送被限制", "reason", e.Message, "retry_after", e.RetryAfter)
+		writeLimited(w, e)
+		return
+	}
+	logger.Debug("收到模板推送", secret("title", redactBody, msg.Title), secret("body", redactBody, msg.Body))
+	if err := pushToKey(r.Context(), key, msg); err != nil {
+		logger.Warn("推送失败", "err", err)
+		fmt.Fprint(w, responseString(400, err.Error()))
+		return
+	}
+	logger.Info("推送成功")
+	fmt.Fprint(w, responseString(200, ""))
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// 浏览器的 PushSubscription，注册时作为 webpush 设备的 token 以 JSON 保存
+type pushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+func parseSubscription(token string) (*pushSubscription, []byte, []byte, error) {
+	var sub pushSubscription
+	if err := json.Unmarshal([]byte(token), &sub); err != nil {
+		return nil, nil, nil, errors.New("PushSubscription 格式不正确")
+	}
+	u, err := url.Parse(sub.Endpoint)
+	if err != nil || u.Scheme != "https" || len(u.Host) == 0 {
+		return nil, nil, nil, errors.New("PushSubscription endpoint 必须是 https 地址")
+	}
+	p256dh, err := decodeBase64URL(sub.Keys.P256dh)
+	if err != nil || len(p256dh) != 65 {
+		return nil, nil, nil, errors.New("PushSubscription p256dh 格式不正确")
+	}
+	auth, err := decodeBase64URL(sub.Keys.Auth)
+	if err != nil || len(auth) != 16 {
+		return nil, nil, nil, errors.New("PushSubscription auth 格式不正确")
+	}
+	return &sub, p256dh, auth, nil
+}
+
+// 浏览器给出的 key 可能带或不带 padding
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// 从注册请求中取 PushSubscription：JSON 请求体、subscription 参数，或者 endpoint/p256dh/auth 三个参数
+func readPushSubscription(r *http.Request) string {
+	var sub pushSubscription
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		json.NewDecoder(r.Body).Decode(&sub)
+	} else if s := r.FormValue("subscription"); len(s) > 0 {
+		json.Unmarshal([]byte(s), &sub)
+	} else {
+		sub.Endpoint = r.FormValue("endpoint")
+		sub.Keys.P256dh = r.FormValue("p256dh")
+		sub.Keys.Auth = r.FormValue("auth")
+	}
+	if len(sub.Endpoint) == 0 {
+		return ""
+	}
+	token, _ := json.Marshal(sub)
+	return string(token)
+}
+
+type webPushProvider struct {
+	key     *ecdsa.PrivateKey
+	public  []byte
+	subject string
+	client  *http.Client
+}
+
+// VAPID 密钥在第一次启动时生成并保存在数据库中，更换密钥会让已有的订阅全部失效
+func newWebPushProvider(subject string) (*webPushProvider, error) {
+	var der []byte
+	err := boltDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("config"))
+		if err != nil {
+			return err
+		}
+		if val := bucket.Get([]byte("vapid")); val != nil {
+			der = append([]byte{}, val...)
+			return nil
+		}
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err = x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("vapid"), der)
+	})
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParseECPrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	public, err := key.PublicKey.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	return &webPushProvider{
+		key:     key,
+		public:  public.Bytes(),
+		subject: subject,
+		client:  newPublicClient(30 * time.Second),
+	}, nil
+}
+
+func (p *webPushProvider) Name() string {
+	return "webpush"
+}
+
+// endpoint 由浏览器给出，和 webhook 一样不允许指向内网
+func (p *webPushProvider) ValidateTarget(token string) error {
+	sub, _, _, err := parseSubscription(token)
+	if err != nil {
+		return err
+	}
+	u, _ := url.Parse(sub.Endpoint)
+	if err := checkPublicURL(u); err != nil {
+		return errors.New("PushSubscription endpoint " + err.Error())
+	}
+	return nil
+}
+
+// 同一个 key 可以订阅多个浏览器，endpoint 相同的视为同一个订阅
+func (p *webPushProvider) SameTarget(a string, b string) bool {
+	subA, _, _, errA := parseSubscription(a)
+	subB, _, _, errB := parseSubscription(b)
+	return errA == nil && errB == nil && subA.Endpoint == subB.Endpoint
+}
+
+// 浏览器订阅时需要的 applicationServerKey
+func (p *webPushProvider) publicKey() string {
+	return base64.RawURLEncoding.EncodeToString(p.public)
+}
+
+func (p *webPushProvider) Send(ctx context.Context, token string, msg *Message) error {
+	sub, p256dh, auth, err := parseSubscription(token)
+	if err != nil {
+		return &PushError{Message: err.Error(), Reason: "BadSubscription", Permanent: true, Invalid: true}
+	}
+	plaintext, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	body, err := encryptWebPush(plaintext, p256dh, auth)
+	if err != nil {
+		return &PushError{Message: err.Error(), Reason: "EncryptFailed", Permanent: true}
+	}
+	authorization, err := p.vapidAuthorization(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return &PushError{Message: "PushSubscription endpoint 不正确", Reason: "BadSubscription", Permanent: true, Invalid: true}
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", "86400")
+	req.Header.Set("Urgency", "high")
+	req.Header.Set("Authorization", authorization)
+	res, err := p.client.Do(req.WithContext(ctx))
+	if errors.Is(err, errPrivateAddress) {
+		return &PushError{Message: "PushSubscription endpoint " + errPrivateAddress.Error(), Reason: "PrivateAddress", Permanent: true}
+	}
+	if err != nil {
+		return &PushError{Message: "与浏览器推送服务器传输数据失败", Reason: "TransportError"}
+	}
+	res.Body.Close()
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+
+	e := &PushError{Message: "推送发送失败 HTTP " + strconv.Itoa(res.StatusCode), Reason: strconv.Itoa(res.StatusCode)}
+	switch {
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone:
+		e.Permanent = true
+		e.Invalid = true
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+	default:
+		e.Permanent = true
+	}
+	return e
+}
+
+// RFC 8292，aud 为推送服务的 origin
+func (p *webPushProvider) vapidAuthorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": p.subject,
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, p.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	// ES256 的签名是定长的 r || s
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	jwt := unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+	return "vapid t=" + jwt + ", k=" + p.publicKey(), nil
+}
+
+const webPushRecordSize = 4096
+
+// RFC 8291 的 aes128gcm 加密，整条消息放在一个 record 中
+func encryptWebPush(plaintext []byte, uaPublic []byte, authSecret []byte) ([]byte, error) {
+	if len(plaintext)+1+16 > webPushRecordSize-86 {
+		return nil, errors.New("消息过长，浏览器推送最多支持约 " + strconv.Itoa(webPushRecordSize-86-17) + " 字节")
+	}
+	curve := ecdh.P256()
+	uaKey, err := curve.NewPublicKey(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	asKey, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asKey.PublicKey().Bytes()
+	sharedSecret, err := asKey.ECDH(uaKey)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublic...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := hkdf(authSecret, sharedSecret, keyInfo, 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// 0x02 表示最后一个 record
+	record := append(append([]byte{}, plaintext...), 0x02)
+	ciphertext := gcm.Seal(nil, nonce, record, nil)
+
+	header := make([]byte, 0, 16+4+1+len(asPublic))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, webPushRecordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+	return append(header, ciphertext...), nil
+}
+
+// HKDF-SHA256，length 不超过 32 时只需要一轮 expand
+func hkdf(salt []byte, secret []byte, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	expand.Write(info)
+	expand.Write([]byte{0x01})
+	return expand.Sum(nil)[:length]
+}
+
+func vapidPublicKey(p *webPushProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		fmt.Fprint(w, responseData(200, map[string]interface{}{"public_key": p.publicKey()}, ""))
+	}
+}
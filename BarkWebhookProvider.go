@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// 把消息以 JSON POST 到注册时提供的 URL，适合没有推送服务的设备或自建服务
+type webhookProvider struct {
+	client *http.Client
+}
+
+func newWebhookProvider() *webhookProvider {
+	return &webhookProvider{client: newPublicClient(15 * time.Second)}
+}
+
+func (p *webhookProvider) Name() string {
+	return "webhook"
+}
+
+func (p *webhookProvider) ValidateTarget(token string) error {
+	u, err := url.Parse(token)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return errors.New("webhook 地址必须是 http 或 https 的完整URL")
+	}
+	if err := checkPublicURL(u); err != nil {
+		return errors.New("webhook 地址" + err.Error())
+	}
+	return nil
+}
+
+func (p *webhookProvider) Send(ctx context.Context, token string, msg *Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", token, bytes.NewReader(body))
+	if err != nil {
+		return &PushError{Message: "webhook 地址不正确", Reason: "BadURL", Permanent: true, Invalid: true}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Bark")
+	res, err := p.client.Do(req.WithContext(ctx))
+	if errors.Is(err, errPrivateAddress) {
+		return &PushError{Message: "webhook 地址" + errPrivateAddress.Error(), Reason: "PrivateAddress", Permanent: true}
+	}
+	if err != nil {
+		return &PushError{Message: "与webhook服务器传输数据失败", Reason: "TransportError"}
+	}
+	res.Body.Close()
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+
+	e := &PushError{Message: "推送发送失败 HTTP " + strconv.Itoa(res.StatusCode), Reason: strconv.Itoa(res.StatusCode)}
+	switch {
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone:
+		e.Permanent = true
+		e.Invalid = true
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+	default:
+		e.Permanent = true
+	}
+	return e
+}
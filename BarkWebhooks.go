@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/go-zoo/bone"
+)
+
+// 每次推送之后把消息和结果 POST 给订阅的地址，用于同步到聊天、审计等系统
+type webhookSubscription struct {
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+}
+
+type webhookEvent struct {
+	ID      string        `json:"id"`
+	Time    time.Time     `json:"time"`
+	Key     string        `json:"key"`
+	Message *Message      `json:"message"`
+	Result  webhookResult `json:"result"`
+}
+
+// Status 为 sent、failed，或者 digested（放进合并窗口）、held（免打扰时段内暂存），后两种稍后发送时会再通知一次
+type webhookResult struct {
+	Success bool       `json:"success"`
+	Status  pushStatus `json:"status"`
+	Error   string     `json:"error,omitempty"`
+}
+
+type webhookDelivery struct {
+	event   *webhookEvent
+	sub     webhookSubscription
+	global  bool
+	attempt int
+}
+
+// 投递日志，死信会带上完整的事件以便人工重放
+type webhookRecord struct {
+	EventID      string        `json:"event_id"`
+	Subscription string        `json:"subscription"`
+	Attempt      int           `json:"attempt"`
+	Status       int           `json:"status,omitempty"`
+	Error        string        `json:"error,omitempty"`
+	Time         time.Time     `json:"time"`
+	Event        *webhookEvent `json:"event,omitempty"`
+}
+
+const webhookLogLimit = 200
+const webhookDeadLimit = 1000
+const webhookMaxPerKey = 10
+
+type webhookDispatcher struct {
+	client      *http.Client
+	keyClient   *http.Client // 请求 key 自己添加的订阅，不允许访问内网
+	global      []webhookSubscription
+	maxAttempts int
+	queue       chan *webhookDelivery
+
+	mu      sync.Mutex
+	retries map[*webhookDelivery]*time.Timer
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+func newWebhookDispatcher(globalURLs []string, globalSecret string, maxAttempts int, workers int) *webhookDispatcher {
+	d := &webhookDispatcher{
+		client:      &http.Client{Timeout: 15 * time.Second},
+		keyClient:   newPublicClient(15 * time.Second),
+		maxAttempts: maxAttempts,
+		queue:       make(chan *webhookDelivery, 1024),
+		retries:     make(map[*webhookDelivery]*time.Timer),
+	}
+	for i, u := range globalURLs {
+		d.global = append(d.global, webhookSubscription{ID: "global-" + strconv.Itoa(i), URL: u, Secret: globalSecret})
+	}
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+	registerQueue("webhook", func() int {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.queue) + len(d.retries)
+	})
+	return d
+}
+
+func (d *webhookDispatcher) onPush(key string, msg *Message, status pushStatus, err error) {
+	subs, e := getWebhooks(key)
+	if e != nil {
+		slog.Warn("读取webhook订阅失败", secret("key", redactKey, key), "err", e)
+	}
+	if len(subs) == 0 && len(d.global) == 0 {
+		return
+	}
+	event := &webhookEvent{ID: newRequestID(), Time: time.Now(), Key: key, Message: msg}
+	event.Result.Success = err == nil
+	event.Result.Status = status
+	if err != nil {
+		event.Result.Error = err.Error()
+	}
+	for _, sub := range d.global {
+		d.enqueue(&webhookDelivery{event: event, sub: sub, global: true})
+	}
+	for _, sub := range subs {
+		d.enqueue(&webhookDelivery{event: event, sub: sub})
+	}
+}
+
+// 不阻塞推送，队列满或已经关闭时直接记为死信
+func (d *webhookDispatcher) enqueue(delivery *webhookDelivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		d.dead(delivery, 0, "服务正在关闭")
+		return
+	}
+	d.wg.Add(1)
+	select {
+	case d.queue <- delivery:
+	default:
+		d.wg.Done()
+		d.dead(delivery, 0, "投递队列已满")
+	}
+}
+
+func (d *webhookDispatcher) work() {
+	for delivery := range d.queue {
+		d.deliver(delivery)
+		d.wg.Done()
+	}
+}
+
+func (d *webhookDispatcher) deliver(delivery *webhookDelivery) {
+	delivery.attempt++
+	status, err := d.post(delivery)
+	d.log(delivery, status, err)
+	if err == nil {
+		return
+	}
+	if delivery.attempt >= d.maxAttempts || (status >= 400 && status < 500 && status != http.StatusTooManyRequests) {
+		d.dead(delivery, status, err.Error())
+		return
+	}
+
+	// 2s, 4s, 8s ... 最长 10 分钟
+	backoff := time.Duration(1<<uint(delivery.attempt)) * time.Second
+	if backoff > 10*time.Minute {
+		backoff = 10 * time.Minute
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		d.dead(delivery, status, err.Error())
+		return
+	}
+	d.retries[delivery] = time.AfterFunc(backoff, func() {
+		d.mu.Lock()
+		delete(d.retries, delivery)
+		d.mu.Unlock()
+		d.enqueue(delivery)
+	})
+}
+
+// 请求体用订阅的 secret 做 HMAC-SHA256 签名，放在 X-Bark-Signature 中
+func (d *webhookDispatcher) post(delivery *webhookDelivery) (int, error) {
+	body, err := json.Marshal(delivery.event)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("POST", delivery.sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Bark")
+	req.Header.Set("X-Bark-Event", delivery.event.ID)
+	req.Header.Set("X-Bark-Delivery-Attempt", strconv.Itoa(delivery.attempt))
+	if len(delivery.sub.Secret) > 0 {
+		mac := hmac.New(sha256.New, []byte(delivery.sub.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Bark-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	client := d.keyClient
+	if delivery.global {
+		client = d.client
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, errors.New("HTTP " + strconv.Itoa(res.StatusCode))
+	}
+	return res.StatusCode, nil
+}
+
+// 全局订阅的日志不对 key 的所有者公开订阅地址
+func (d *webhookDispatcher) record(delivery *webhookDelivery, status int, errMsg string) *webhookRecord {
+	subscription := delivery.sub.ID
+	if !delivery.global {
+		subscription += " " + delivery.sub.URL
+	}
+	return &webhookRecord{
+		EventID:      delivery.event.ID,
+		Subscription: subscription,
+		Attempt:      delivery.attempt,
+		Status:       status,
+		Error:        errMsg,
+		Time:         time.Now(),
+	}
+}
+
+func (d *webhookDispatcher) log(delivery *webhookDelivery, status int, err error) {
+	errMsg := ""
+	if err != nil {
+		errMsg = err.Error()
+		slog.Warn("webhook投递失败", "event", delivery.event.ID, "subscription", delivery.sub.ID, "attempt", delivery.attempt, "err", err)
+	}
+	if _, e := appendRecord("webhook_log", delivery.event.Key, d.record(delivery, status, errMsg), webhookLogLimit); e != nil {
+		slog.Error("保存webhook投递日志失败", "err", e)
+	}
+}
+
+func (d *webhookDispatcher) dead(delivery *webhookDelivery, status int, reason string) {
+	slog.Error("webhook投递失败，已记为死信", "event", delivery.event.ID, "subscription", delivery.sub.ID, "attempt", delivery.attempt, "reason", reason)
+	record := d.record(delivery, status, reason)
+	record.Event = delivery.event
+	if _, err := appendRecord("webhook_dead", delivery.event.Key, record, webhookDeadLimit); err != nil {
+		slog.Error("保存webhook死信失败", "err", err)
+	}
+}
+
+// 退出时等待队列中的投递完成，还在等待重试的直接记为死信
+func (d *webhookDispatcher) shutdown(ctx context.Context) {
+	d.mu.Lock()
+	d.closed = true
+	for delivery, timer := range d.retries {
+		if timer.Stop() {
+			d.dead(delivery, 0, "服务关闭时仍在等待重试")
+		}
+		delete(d.retries, delivery)
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("等待webhook投递超时", "pending", len(d.queue))
+	}
+}
+
+func getWebhooks(key string) ([]webhookSubscription, error) {
+	var subs []webhookSubscription
+	err := boltDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("webhook"))
+		if bucket == nil {
+			return nil
+		}
+		val := bucket.Get([]byte(key))
+		if val == nil {
+			return nil
+		}
+		return json.Unmarshal(val, &subs)
+	})
+	return subs, err
+}
+
+func updateWebhooks(key string, fn func(subs []webhookSubscription) []webhookSubscription) error {
+	return boltDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("webhook"))
+		if err != nil {
+			return err
+		}
+		var subs []webhookSubscription
+		if val := bucket.Get([]byte(key)); val != nil {
+			if err := json.Unmarshal(val, &subs); err != nil {
+				return err
+			}
+		}
+		val, err := json.Marshal(fn(subs))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), val)
+	})
+}
+
+// GET 列出 key 的订阅，POST 添加订阅(url, secret)，未提供 secret 时自动生成
+func webhooks(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	key := bone.GetValue(r, "key")
+	if !keyExists(key) {
+		fmt.Fprint(w, responseString(400, "找不到key对应的DeviceToken, 请确保Key正确! Key可在App端注册获得。"))
+		return
+	}
+
+	if r.Method == "POST" {
+		r.ParseForm()
+		u, err := url.Parse(r.FormValue("url"))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			fmt.Fprint(w, responseString(400, "url 必须是 http 或 https 的完整地址"))
+			return
+		}
+		if err := checkPublicURL(u); err != nil {
+			fmt.Fprint(w, responseString(400, "url "+err.Error()))
+			return
+		}
+		sub := webhookSubscription{ID: newRequestID(), URL: u.String(), Secret: r.FormValue("secret")}
+		if len(sub.Secret) == 0 {
+			sub.Secret = newRequestID() + newRequestID()
+		}
+		full := false
+		err = updateWebhooks(key, func(subs []webhookSubscription) []webhookSubscription {
+			if len(subs) >= webhookMaxPerKey {
+				full = true
+				return subs
+			}
+			return append(subs, sub)
+		})
+		if full {
+			fmt.Fprint(w, responseString(400, "每个key最多添加 "+strconv.Itoa(webhookMaxPerKey)+" 个webhook订阅"))
+			return
+		}
+		if err != nil {
+			fmt.Fprint(w, responseString(500, err.Error()))
+			return
+		}
+		fmt.Fprint(w, responseData(200, sub, "添加成功"))
+		return
+	}
+
+	subs, err := getWebhooks(key)
+	if err != nil {
+		fmt.Fprint(w, responseString(500, err.Error()))
+		return
+	}
+	for i := range subs {
+		subs[i].Secret = ""
+	}
+	fmt.Fprint(w, responseData(200, subs, ""))
+}
+
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	key := bone.GetValue(r, "key")
+	id := bone.GetValue(r, "id")
+	if !keyExists(key) {
+		fmt.Fprint(w, responseString(400, "找不到key对应的DeviceToken, 请确保Key正确! Key可在App端注册获得。"))
+		return
+	}
+	found := false
+	err := updateWebhooks(key, func(subs []webhookSubscription) []webhookSubscription {
+		result := []webhookSubscription{}
+		for _, sub := range subs {
+			if sub.ID == id {
+				found = true
+				continue
+			}
+			result = append(result, sub)
+		}
+		return result
+	})
+	if err != nil {
+		fmt.Fprint(w, responseString(500, err.Error()))
+		return
+	}
+	if !found {
+		fmt.Fprint(w, responseString(400, "找不到对应的webhook订阅"))
+		return
+	}
+	fmt.Fprint(w, responseString(200, "删除成功"))
+}
+
+// 最近的投递日志和死信
+func webhookLog(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	key := bone.GetValue(r, "key")
+	if !keyExists(key) {
+		fmt.Fprint(w, responseString(400, "找不到key对应的DeviceToken, 请确保Key正确! Key可在App端注册获得。"))
+		return
+	}
+	deliveries := []json.RawMessage{}
+	dead := []json.RawMessage{}
+	err := listRecords("webhook_log", key, 0, webhookLogLimit, func(seq uint64, val []byte) error {
+		deliveries = append(deliveries, append(json.RawMessage{}, val...))
+		return nil
+	})
+	if err == nil {
+		err = listRecords("webhook_dead", key, 0, webhookLogLimit, func(seq uint64, val []byte) error {
+			dead = append(dead, append(json.RawMessage{}, val...))
+			return nil
+		})
+	}
+	if err != nil {
+		fmt.Fprint(w, responseString(500, err.Error()))
+		return
+	}
+	fmt.Fprint(w, responseData(200, map[string]interface{}{"deliveries": deliveries, "dead": dead}, ""))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// 解析 APNs payload，返回 aps 字典和其它自定义字段
+func apnsPayload(t *testing.T, msg *Message) (map[string]interface{}, map[string]interface{}) {
+	t.Helper()
+	notification, _ := buildNotification("token", msg)
+	data, err := json.Marshal(notification.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := map[string]interface{}{}
+	if err := json.Unmarshal(data, &content); err != nil {
+		t.Fatal(err)
+	}
+	aps, _ := content["aps"].(map[string]interface{})
+	return aps, content
+}
+
+func TestBuildNotificationLevel(t *testing.T) {
+	cases := map[string]string{
+		"passive":       "passive",
+		"active":        "active",
+		"timeSensitive": "time-sensitive",
+		"critical":      "critical",
+	}
+	for level, want := range cases {
+		aps, content := apnsPayload(t, &Message{Body: "hi", Params: map[string]interface{}{"level": level, "group": "g"}})
+		if aps["interruption-level"] != want {
+			t.Errorf("level %s: interruption-level = %v, want %s", level, aps["interruption-level"], want)
+		}
+		if _, ok := content["level"]; ok {
+			t.Errorf("level %s: level should not be a custom key", level)
+		}
+		if content["group"] != "g" {
+			t.Errorf("level %s: custom key group = %v, want g", level, content["group"])
+		}
+	}
+
+	aps, _ := apnsPayload(t, &Message{Body: "hi", Params: map[string]interface{}{"level": "loud"}})
+	if _, ok := aps["interruption-level"]; ok {
+		t.Errorf("unknown level: interruption-level = %v, want none", aps["interruption-level"])
+	}
+}
+
+// ntfy 的 X-Priority 最终要变成 aps.interruption-level
+func TestNtfyPriorityLevel(t *testing.T) {
+	cases := map[int]string{1: "passive", 2: "passive", 3: "active", 4: "time-sensitive", 5: "time-sensitive"}
+	for priority, want := range cases {
+		aps, _ := apnsPayload(t, &Message{Body: "hi", Params: ntfyParams(&ntfyMessage{Topic: "t", Priority: priority})})
+		if aps["interruption-level"] != want {
+			t.Errorf("priority %d: interruption-level = %v, want %s", priority, aps["interruption-level"], want)
+		}
+	}
+}
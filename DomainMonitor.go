@@ -5,20 +5,40 @@ import (
 	"github.com/likexian/whois-parser-go"
 	"io/ioutil"
 	"strings"
-	"log"
-	"net/http"
+	"log/slog"
+	"context"
 	"time"
 	"strconv"
+	"flag"
+	"os"
 
 	"github.com/kardianos/osext"
 	"github.com/araddon/dateparse"
+	"github.com/hugo2lee/go-tools/bark"
 )
 
 func main() {
+	logFormat := flag.String("log-format", "text", "日志格式: text(logfmt) 或 json")
+	logLevel := flag.String("log-level", "info", "日志级别: debug, info, warn, error")
+	flag.Parse()
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		slog.Error("未知的日志级别", "level", *logLevel)
+		os.Exit(1)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	if *logFormat == "json" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	} else {
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	}
+
 	path,_ := osext.ExecutableFolder()
 	domainFile, err := ioutil.ReadFile(path + "/domain")
 	if err != nil{
-		log.Fatalln("打开文件失败")
+		slog.Error("打开文件失败", "path", path + "/domain", "err", err)
+		os.Exit(1)
 	}
 
 	var min int64 = 9999999
@@ -48,6 +68,7 @@ func main() {
 		updateTime := dateFormat(r.Registrar.UpdatedDate)
 
 		a := (expTime.Unix() - time.Now().Unix()) / 24 / 60 / 60
+		slog.Info("查询成功", "domain", line, "days", a, "expiration", expTime)
 
 		body := line + "  " + strconv.Itoa(int(a)) + "天" + "\n过期时间: " + expTime.Format("2006-01-02 15:04:05") + "\n更新时间: " + updateTime.Format("2006-01-02 15:04:05")
 
@@ -75,11 +96,19 @@ func dateFormat(date string)time.Time {
 }
 
 func sendFailedPush(domain string, reason string){
+	slog.Warn("查询失败", "domain", domain, "reason", reason)
 	sendNotification("域名: " + domain + " 查询失败 reason: " + reason)
 }
 
+var barkClient = bark.NewClient("https://api.uusing.com", "PeNX4RrNFYkwgQYx8jYKck")
+
 func sendNotification(body string){
-	url := "https://api.uusing.com/PeNX4RrNFYkwgQYx8jYKck/alert"
-	http.Post(url, "application/x-www-form-urlencoded", strings.NewReader("body="+body))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := barkClient.Send(ctx, body, bark.WithTitle("alert"), bark.WithGroup("DomainMonitor")); err != nil {
+		slog.Error("发送推送失败", "err", err)
+		return
+	}
+	slog.Debug("发送推送成功")
 }
 
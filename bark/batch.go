@@ -0,0 +1,60 @@
+package bark
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// PushChan 中每条推送的结果
+type Result struct {
+	Message *Message
+	Err     error
+}
+
+// 依次推送多条消息给 Client.Key，返回所有失败的错误
+func (c *Client) PushAll(ctx context.Context, msgs ...*Message) error {
+	var errs []error
+	for _, msg := range msgs {
+		if err := c.Push(ctx, msg); err != nil {
+			errs = append(errs, err)
+		}
+		if ctx.Err() != nil {
+			errs = append(errs, ctx.Err())
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// 用 workers 个 goroutine 推送 ch 中的消息给 Client.Key，每条的结果写入返回的 channel。
+// ch 关闭或 ctx 取消后，处理完手上的消息就关闭返回的 channel；调用方需要读完结果
+func (c *Client) PushChan(ctx context.Context, ch <-chan *Message, workers int) <-chan Result {
+	if workers < 1 {
+		workers = 1
+	}
+	results := make(chan Result, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case msg, ok := <-ch:
+					if !ok {
+						return
+					}
+					results <- Result{Message: msg, Err: c.Push(ctx, msg)}
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
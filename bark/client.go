@@ -0,0 +1,185 @@
+// Package bark 是 Bark 推送服务的 Go 客户端。
+//
+//	client := bark.NewClient("https://api.day.app", "your-key")
+//	err := client.Send(ctx, "备份完成", bark.WithTitle("NAS"), bark.WithLevel(bark.Passive))
+package bark
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 服务端的响应
+type Response struct {
+	Code    int             `json:"code"`
+	Data    json.RawMessage `json:"data"`
+	Message string          `json:"message"`
+}
+
+// 服务端返回的错误，StatusCode 为 HTTP 状态码，Code 为响应中的 code
+type Error struct {
+	StatusCode int
+	Code       int
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return "bark: " + strconv.Itoa(e.Code) + " " + e.Message
+}
+
+// 被限流、服务端出错时可以重试，参数错误、key 不存在等不能重试
+func (e *Error) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500 || e.Code == 429 || e.Code >= 500
+}
+
+type Client struct {
+	// 服务地址，例如 https://api.day.app
+	Server string
+	// Push、Send 默认推送的 key
+	Key        string
+	HTTPClient *http.Client
+	// 失败后最多重试的次数，每次等待 RetryWait 的 2 的幂次倍，服务端给出 Retry-After 时按它等待
+	Retries   int
+	RetryWait time.Duration
+	// Retry-After 超过 MaxRetryWait 时不再等待，直接返回 *Error，为 0 时不限制
+	MaxRetryWait time.Duration
+}
+
+func NewClient(server string, key string) *Client {
+	return &Client{
+		Server:       strings.TrimRight(server, "/"),
+		Key:          key,
+		HTTPClient:   &http.Client{Timeout: 10 * time.Second},
+		Retries:      2,
+		RetryWait:    time.Second,
+		MaxRetryWait: 30 * time.Second,
+	}
+}
+
+// 推送给 Client.Key
+func (c *Client) Push(ctx context.Context, msg *Message) error {
+	if len(c.Key) == 0 {
+		return errors.New("bark: 没有设置 key")
+	}
+	return c.PushTo(ctx, []string{c.Key}, msg)
+}
+
+// 推送给多个 key，有一个推送成功就返回 nil
+func (c *Client) PushTo(ctx context.Context, keys []string, msg *Message) error {
+	if len(keys) == 0 {
+		return errors.New("bark: 没有设置 key")
+	}
+	body, err := msg.payload(keys)
+	if err != nil {
+		return err
+	}
+	idempotencyKey := msg.IdempotencyKey
+	if len(idempotencyKey) == 0 {
+		idempotencyKey = newIdempotencyKey()
+	}
+
+	for attempt := 0; ; attempt++ {
+		_, err = c.do(ctx, "POST", "/push", body, idempotencyKey)
+		if err == nil || attempt >= c.Retries || !retryable(err) {
+			return err
+		}
+		wait := c.RetryWait << attempt
+		var e *Error
+		if errors.As(err, &e) && e.RetryAfter > 0 {
+			if c.MaxRetryWait > 0 && e.RetryAfter > c.MaxRetryWait {
+				return err
+			}
+			wait = e.RetryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// 推送一段文字给 Client.Key
+func (c *Client) Send(ctx context.Context, body string, opts ...Option) error {
+	msg := &Message{Body: body}
+	for _, opt := range opts {
+		opt(msg)
+	}
+	return c.Push(ctx, msg)
+}
+
+// 检查服务是否可用
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.do(ctx, "GET", "/ping", nil, "")
+	return err
+}
+
+func retryable(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Temporary()
+	}
+	// 取消和超时不重试，其它网络错误重试
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+func (c *Client) do(ctx context.Context, method string, path string, body []byte, idempotencyKey string) (*Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.Server+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(idempotencyKey) > 0 {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	resp := &Response{}
+	if err := json.Unmarshal(data, resp); err != nil {
+		return nil, &Error{StatusCode: res.StatusCode, Code: res.StatusCode, Message: fmt.Sprintf("无法解析响应: %.200s", data)}
+	}
+	if res.StatusCode >= 300 || resp.Code != 200 {
+		e := &Error{StatusCode: res.StatusCode, Code: resp.Code, Message: resp.Message}
+		if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+			e.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return resp, e
+	}
+	return resp, nil
+}
+
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,220 @@
+package bark
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记录收到的 /push 请求，按 responses 的顺序依次返回
+type fakeServer struct {
+	mu        sync.Mutex
+	requests  []map[string]interface{}
+	keys      []string
+	responses []func(w http.ResponseWriter)
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.URL.Path != "/push" || r.Method != "POST" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	req := map[string]interface{}{}
+	json.NewDecoder(r.Body).Decode(&req)
+	s.requests = append(s.requests, req)
+	s.keys = append(s.keys, r.Header.Get("Idempotency-Key"))
+
+	respond := func(w http.ResponseWriter) {
+		w.Write([]byte(`{"code":200,"data":null,"message":""}`))
+	}
+	if len(s.responses) > 0 {
+		respond = s.responses[0]
+		s.responses = s.responses[1:]
+	}
+	respond(w)
+}
+
+func newTestClient(t *testing.T, s *fakeServer) *Client {
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	c := NewClient(srv.URL+"/", "test-key")
+	c.RetryWait = time.Millisecond
+	return c
+}
+
+func reply(status int, body string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}
+}
+
+func TestSend(t *testing.T) {
+	s := &fakeServer{}
+	c := newTestClient(t, s)
+	err := c.Send(context.Background(), "备份完成", WithTitle("NAS"), WithLevel(Passive), WithGroup("backup"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.requests) != 1 {
+		t.Fatalf("requests = %d, want 1", len(s.requests))
+	}
+	req := s.requests[0]
+	want := map[string]interface{}{"device_key": "test-key", "body": "备份完成", "title": "NAS", "level": "passive", "group": "backup"}
+	for name, value := range want {
+		if req[name] != value {
+			t.Errorf("%s = %v, want %v", name, req[name], value)
+		}
+	}
+	if len(s.keys[0]) == 0 {
+		t.Error("missing Idempotency-Key header")
+	}
+}
+
+func TestPushToMultipleKeys(t *testing.T) {
+	s := &fakeServer{}
+	c := newTestClient(t, s)
+	if err := c.PushTo(context.Background(), []string{"a", "b"}, &Message{Body: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	keys, _ := s.requests[0]["device_keys"].([]interface{})
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Errorf("device_keys = %v, want [a b]", s.requests[0]["device_keys"])
+	}
+}
+
+// 服务端在 HTTP 200 中用 code 返回错误
+func TestJSONErrorCode(t *testing.T) {
+	s := &fakeServer{responses: []func(w http.ResponseWriter){
+		reply(http.StatusOK, `{"code":400,"data":null,"message":"找不到key对应的DeviceToken"}`),
+	}}
+	c := newTestClient(t, s)
+	err := c.Send(context.Background(), "hi")
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("err = %v, want *Error", err)
+	}
+	if e.StatusCode != http.StatusOK || e.Code != 400 || e.Message != "找不到key对应的DeviceToken" {
+		t.Errorf("err = %+v", e)
+	}
+	if e.Temporary() {
+		t.Error("400 should not be temporary")
+	}
+	if len(s.requests) != 1 {
+		t.Errorf("requests = %d, want 1 (no retry)", len(s.requests))
+	}
+}
+
+func TestInvalidResponse(t *testing.T) {
+	s := &fakeServer{responses: []func(w http.ResponseWriter){
+		reply(http.StatusBadGateway, "<html>bad gateway</html>"),
+		reply(http.StatusBadGateway, "<html>bad gateway</html>"),
+		reply(http.StatusBadGateway, "<html>bad gateway</html>"),
+	}}
+	c := newTestClient(t, s)
+	err := c.Send(context.Background(), "hi")
+	var e *Error
+	if !errors.As(err, &e) || e.StatusCode != http.StatusBadGateway {
+		t.Fatalf("err = %v, want HTTP 502", err)
+	}
+	if len(s.requests) != 3 {
+		t.Errorf("requests = %d, want 3", len(s.requests))
+	}
+}
+
+// 限流和服务端错误重试，重试使用同一个幂等键
+func TestRetry(t *testing.T) {
+	s := &fakeServer{responses: []func(w http.ResponseWriter){
+		func(w http.ResponseWriter) {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"code":429,"data":null,"message":"推送过于频繁，请稍后再试"}`))
+		},
+		reply(http.StatusOK, `{"code":500,"data":null,"message":"服务器错误"}`),
+	}}
+	c := newTestClient(t, s)
+	if err := c.Send(context.Background(), "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.requests) != 3 {
+		t.Fatalf("requests = %d, want 3", len(s.requests))
+	}
+	if s.keys[0] != s.keys[1] || s.keys[1] != s.keys[2] {
+		t.Errorf("Idempotency-Key changed between retries: %v", s.keys)
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	s := &fakeServer{}
+	for i := 0; i < 5; i++ {
+		s.responses = append(s.responses, reply(http.StatusServiceUnavailable, `{"code":503,"data":null,"message":"服务正在关闭"}`))
+	}
+	c := newTestClient(t, s)
+	c.Retries = 1
+	err := c.Send(context.Background(), "hi")
+	var e *Error
+	if !errors.As(err, &e) || e.Code != 503 || !e.Temporary() {
+		t.Fatalf("err = %v, want temporary 503", err)
+	}
+	if len(s.requests) != 2 {
+		t.Errorf("requests = %d, want 2", len(s.requests))
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	s := &fakeServer{responses: []func(w http.ResponseWriter){
+		func(w http.ResponseWriter) {
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"code":429,"data":null,"message":"推送过于频繁，请稍后再试"}`))
+		},
+	}}
+	c := newTestClient(t, s)
+	// 等待 Retry-After 期间取消
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.Send(ctx, "hi"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if len(s.requests) != 1 {
+		t.Errorf("requests = %d, want 1", len(s.requests))
+	}
+}
+
+// Retry-After 超过 MaxRetryWait 时直接返回，交给调用方决定
+func TestRetryAfterTooLong(t *testing.T) {
+	s := &fakeServer{responses: []func(w http.ResponseWriter){
+		func(w http.ResponseWriter) {
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"code":429,"data":null,"message":"推送过于频繁，请稍后再试"}`))
+		},
+	}}
+	c := newTestClient(t, s)
+	start := time.Now()
+	err := c.Send(context.Background(), "hi")
+	var e *Error
+	if !errors.As(err, &e) || e.Code != 429 || e.RetryAfter != 120*time.Second {
+		t.Fatalf("err = %v, want 429 with Retry-After 120s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("returned after %v, should not wait", elapsed)
+	}
+	if len(s.requests) != 1 {
+		t.Errorf("requests = %d, want 1", len(s.requests))
+	}
+}
+
+func TestMissingKey(t *testing.T) {
+	c := NewClient("http://127.0.0.1", "")
+	if err := c.Send(context.Background(), "hi"); err == nil {
+		t.Fatal("want error without key")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// 配置文件，默认在 ~/.config/bark/config.json：
+//
+//	{
+//	  "default": "phone",
+//	  "targets": {
+//	    "phone": {"server": "https://api.day.app", "key": "xxxx"},
+//	    "ops": {"server": "https://bark.example.com", "key": "yyyy"}
+//	  }
+//	}
+type config struct {
+	Default string            `json:"default"`
+	Targets map[string]target `json:"targets"`
+}
+
+type target struct {
+	Server string `json:"server"`
+	Key    string `json:"key"`
+}
+
+const defaultServer = "https://api.day.app"
+
+func defaultConfigPath() string {
+	if path := os.Getenv("BARK_CONFIG"); len(path) > 0 {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "bark", "config.json")
+}
+
+// 配置文件不存在时返回空配置
+func loadConfig(path string) (*config, error) {
+	cfg := &config{Targets: map[string]target{}}
+	if len(path) == 0 {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, errors.New("配置文件 " + path + " 格式不正确: " + err.Error())
+	}
+	return cfg, nil
+}
+
+// 按优先级确定推送目标：-key 可以是配置中的名字或者 key 本身，其次是环境变量 BARK_KEY、配置的 default；
+// 服务地址依次取 -server、目标的 server、环境变量 BARK_SERVER、default 目标的 server，都没有时使用 api.day.app
+func (cfg *config) resolve(name string, server string) (target, error) {
+	if len(name) == 0 {
+		name = os.Getenv("BARK_KEY")
+	}
+	if len(name) == 0 {
+		name = cfg.Default
+	}
+	if len(name) == 0 {
+		return target{}, errors.New("没有指定 key，请使用 -key、BARK_KEY 或者在配置文件中设置 default")
+	}
+	t, ok := cfg.Targets[name]
+	if !ok {
+		t = target{Key: name}
+	}
+	if len(server) > 0 {
+		t.Server = server
+	}
+	if len(t.Server) == 0 {
+		t.Server = os.Getenv("BARK_SERVER")
+	}
+	if len(t.Server) == 0 {
+		t.Server = cfg.Targets[cfg.Default].Server
+	}
+	if len(t.Server) == 0 {
+		t.Server = defaultServer
+	}
+	if len(t.Key) == 0 {
+		return target{}, errors.New("配置中的 " + name + " 没有设置 key")
+	}
+	return t, nil
+}
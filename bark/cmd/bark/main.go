@@ -0,0 +1,173 @@
+// bark 是 Bark 推送的命令行工具。
+//
+//	bark -title 备份 "备份完成"
+//	tail -n 20 error.log | bark -key ops -level timeSensitive -title 错误日志
+//	bark run -- make deploy
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hugo2lee/go-tools/bark"
+)
+
+// 从标准输入读取内容时最多保留的字节数，超过时保留末尾，日志的最后几行通常最有用
+const maxBody = 3500
+
+type options struct {
+	key        string
+	server     string
+	configPath string
+	title      string
+	category   string
+	sound      string
+	level      string
+	url        string
+	group      string
+	icon       string
+	params     paramFlag
+	timeout    time.Duration
+	retries    int
+}
+
+// -param name=value，可以重复
+type paramFlag map[string]string
+
+func (p paramFlag) String() string {
+	var list []string
+	for name, value := range p {
+		list = append(list, name+"="+value)
+	}
+	return strings.Join(list, ",")
+}
+
+func (p paramFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || len(name) == 0 {
+		return fmt.Errorf("参数应为 name=value: %s", s)
+	}
+	p[name] = value
+	return nil
+}
+
+func (o *options) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.key, "key", "", "推送的 key，或配置文件中的名字")
+	fs.StringVar(&o.server, "server", "", "服务地址，默认取配置文件或 BARK_SERVER，都没有时为 "+defaultServer)
+	fs.StringVar(&o.configPath, "config", defaultConfigPath(), "配置文件")
+	fs.StringVar(&o.title, "title", "", "标题")
+	fs.StringVar(&o.category, "category", "", "分类")
+	fs.StringVar(&o.sound, "sound", "", "铃声")
+	fs.StringVar(&o.level, "level", "", "打扰程度: passive, active, timeSensitive, critical")
+	fs.StringVar(&o.url, "url", "", "点击通知时打开的地址")
+	fs.StringVar(&o.group, "group", "", "分组")
+	fs.StringVar(&o.icon, "icon", "", "图标地址")
+	o.params = paramFlag{}
+	fs.Var(o.params, "param", "其它推送参数 name=value，可以重复")
+	fs.DurationVar(&o.timeout, "timeout", 30*time.Second, "推送的超时时间，包括重试")
+	fs.IntVar(&o.retries, "retries", 2, "推送失败时的重试次数")
+}
+
+func (o *options) client() (*bark.Client, error) {
+	cfg, err := loadConfig(o.configPath)
+	if err != nil {
+		return nil, err
+	}
+	t, err := cfg.resolve(o.key, o.server)
+	if err != nil {
+		return nil, err
+	}
+	client := bark.NewClient(t.Server, t.Key)
+	client.Retries = o.retries
+	return client, nil
+}
+
+func (o *options) message(body string) *bark.Message {
+	return &bark.Message{
+		Title:    o.title,
+		Body:     body,
+		Category: o.category,
+		Sound:    o.sound,
+		Level:    bark.Level(o.level),
+		URL:      o.url,
+		Group:    o.group,
+		Icon:     o.icon,
+		Params:   o.params,
+	}
+}
+
+func (o *options) push(msg *bark.Message) error {
+	client, err := o.client()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	defer cancel()
+	return client.Push(ctx, msg)
+}
+
+// 只保留末尾的 n 个字节，不截断 UTF-8 字符
+func tail(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	s = s[len(s)-n:]
+	for len(s) > 0 && !utf8.RuneStart(s[0]) {
+		s = s[1:]
+	}
+	return "…" + s
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `用法:
+  bark [选项] [内容...]           发送推送，没有内容或内容为 - 时从标准输入读取
+  bark run [选项] -- 命令 [参数...] 执行命令，结束后推送退出状态、耗时和最后几行输出
+
+使用 bark -h 或 bark run -h 查看选项`)
+}
+
+func send(args []string) int {
+	fs := flag.NewFlagSet("bark", flag.ExitOnError)
+	opts := &options{}
+	opts.register(fs)
+	fs.Usage = func() {
+		usage()
+		fmt.Fprintln(os.Stderr, "\n选项:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	body := strings.Join(fs.Args(), " ")
+	if len(body) == 0 || body == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "读取标准输入失败:", err)
+			return 1
+		}
+		body = tail(strings.TrimRight(string(data), "\n"), maxBody)
+	}
+	if len(strings.TrimSpace(body)) == 0 {
+		fmt.Fprintln(os.Stderr, "没有推送内容")
+		return 2
+	}
+
+	if err := opts.push(opts.message(body)); err != nil {
+		fmt.Fprintln(os.Stderr, "推送失败:", err)
+		return 1
+	}
+	return 0
+}
+
+func main() {
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "run" {
+		os.Exit(run(args[1:]))
+	}
+	os.Exit(send(args))
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hugo2lee/go-tools/bark"
+)
+
+// 保存输出的最后几行，命令的标准输出和标准错误都写到这里
+type tailBuffer struct {
+	mu    sync.Mutex
+	lines []string
+	max   int
+	part  string
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	text := t.part + string(p)
+	lines := strings.Split(text, "\n")
+	t.part = lines[len(lines)-1]
+	// 没有换行的超长输出只保留末尾
+	if len(t.part) > maxBody {
+		t.part = tail(t.part, maxBody)
+	}
+	for _, line := range lines[:len(lines)-1] {
+		t.lines = append(t.lines, strings.TrimRight(line, "\r"))
+		if len(t.lines) > t.max {
+			t.lines = t.lines[1:]
+		}
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lines := t.lines
+	if len(t.part) > 0 {
+		lines = append(append([]string{}, lines...), t.part)
+		if len(lines) > t.max {
+			lines = lines[1:]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// 执行命令，输出照常打印，结束后推送结果；返回命令的退出码
+func run(args []string) int {
+	fs := flag.NewFlagSet("bark run", flag.ExitOnError)
+	opts := &options{}
+	opts.register(fs)
+	lines := fs.Int("lines", 10, "推送中附带的输出行数，0 不附带")
+	onlyFailure := fs.Bool("only-failure", false, "只在命令失败时推送")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "用法: bark run [选项] -- 命令 [参数...]\n\n选项:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	// 提前检查配置，不要等命令执行完才发现推不出去
+	if _, err := opts.client(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	output := &tailBuffer{max: *lines}
+	cmd := exec.Command(fs.Arg(0), fs.Args()[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = io.MultiWriter(os.Stdout, output)
+	cmd.Stderr = io.MultiWriter(os.Stderr, output)
+
+	// Ctrl-C 等信号转发给命令，自己等命令退出后推送结果
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	start := time.Now()
+	code := 0
+	err := cmd.Start()
+	if err == nil {
+		done := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case sig := <-signals:
+					cmd.Process.Signal(sig)
+				case <-done:
+					return
+				}
+			}
+		}()
+		err = cmd.Wait()
+		close(done)
+	}
+	elapsed := time.Since(start)
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		code = exitErr.ExitCode()
+		if code < 0 {
+			// 被信号终止
+			code = 128
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+				code += int(status.Signal())
+			}
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "执行失败:", err)
+		output.Write([]byte(err.Error() + "\n"))
+		code = 127
+	}
+
+	if code == 0 && *onlyFailure {
+		return code
+	}
+	msg := runMessage(opts, fs.Args(), code, elapsed, output.String())
+	if err := opts.push(msg); err != nil {
+		fmt.Fprintln(os.Stderr, "推送失败:", err)
+	}
+	return code
+}
+
+func runMessage(opts *options, command []string, code int, elapsed time.Duration, output string) *bark.Message {
+	name := filepath.Base(command[0])
+	commandLine := strings.Join(command, " ")
+
+	msg := opts.message("")
+	if len(msg.Title) == 0 {
+		if code == 0 {
+			msg.Title = "✅ " + name + " 完成"
+		} else {
+			msg.Title = "❌ " + name + " 失败，退出码 " + strconv.Itoa(code)
+		}
+	}
+	if len(msg.Level) == 0 && code != 0 {
+		msg.Level = bark.TimeSensitive
+	}
+	if len(msg.Group) == 0 {
+		msg.Group = name
+	}
+
+	body := []string{tail(commandLine, 200), "耗时 " + elapsed.Round(time.Millisecond).String()}
+	if len(output) > 0 {
+		body = append(body, "", output)
+	}
+	msg.Body = tail(strings.Join(body, "\n"), maxBody)
+	return msg
+}
@@ -0,0 +1,102 @@
+package bark
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// 通知的打扰程度
+type Level string
+
+const (
+	Passive       Level = "passive"
+	Active        Level = "active"
+	TimeSensitive Level = "timeSensitive"
+	Critical      Level = "critical"
+)
+
+// 一条推送，空的字段不会发送。Params 中是其它推送参数，与服务端的 URL 参数含义一致
+type Message struct {
+	Title      string
+	Body       string
+	Category   string
+	Sound      string
+	Level      Level
+	URL        string
+	Group      string
+	Icon       string
+	Image      string
+	Copy       string
+	AutoCopy   bool
+	Badge      int
+	CollapseID string
+	Params     map[string]string
+
+	// 重试时用同一个幂等键，服务端只会推送一次；为空时由 Client 生成
+	IdempotencyKey string
+}
+
+// 用于 Client.Send 的推送选项
+type Option func(m *Message)
+
+func WithTitle(title string) Option       { return func(m *Message) { m.Title = title } }
+func WithCategory(category string) Option { return func(m *Message) { m.Category = category } }
+func WithSound(sound string) Option       { return func(m *Message) { m.Sound = sound } }
+func WithLevel(level Level) Option        { return func(m *Message) { m.Level = level } }
+func WithURL(url string) Option           { return func(m *Message) { m.URL = url } }
+func WithGroup(group string) Option       { return func(m *Message) { m.Group = group } }
+func WithIcon(icon string) Option         { return func(m *Message) { m.Icon = icon } }
+func WithImage(image string) Option       { return func(m *Message) { m.Image = image } }
+func WithCopy(text string) Option         { return func(m *Message) { m.Copy = text } }
+func WithAutoCopy() Option                { return func(m *Message) { m.AutoCopy = true } }
+func WithBadge(badge int) Option          { return func(m *Message) { m.Badge = badge } }
+func WithCollapseID(id string) Option     { return func(m *Message) { m.CollapseID = id } }
+
+func WithIdempotencyKey(key string) Option {
+	return func(m *Message) { m.IdempotencyKey = key }
+}
+
+func WithParam(name string, value string) Option {
+	return func(m *Message) {
+		if m.Params == nil {
+			m.Params = map[string]string{}
+		}
+		m.Params[name] = value
+	}
+}
+
+// 生成 POST /push 的请求体
+func (m *Message) payload(keys []string) ([]byte, error) {
+	req := map[string]interface{}{}
+	for name, value := range m.Params {
+		req[name] = value
+	}
+	set := func(name string, value string) {
+		if len(value) > 0 {
+			req[name] = value
+		}
+	}
+	set("title", m.Title)
+	set("body", m.Body)
+	set("category", m.Category)
+	set("sound", m.Sound)
+	set("level", string(m.Level))
+	set("url", m.URL)
+	set("group", m.Group)
+	set("icon", m.Icon)
+	set("image", m.Image)
+	set("copy", m.Copy)
+	set("collapse_id", m.CollapseID)
+	if m.AutoCopy {
+		req["autocopy"] = "1"
+	}
+	if m.Badge > 0 {
+		req["badge"] = strconv.Itoa(m.Badge)
+	}
+	if len(keys) == 1 {
+		req["device_key"] = keys[0]
+	} else {
+		req["device_keys"] = keys
+	}
+	return json.Marshal(req)
+}